@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp10 "github.com/Azure/go-amqp"
+	"github.com/streadway/amqp"
+)
+
+// amqp10Timeout bounds the connection, the attachment of a link and the settlement of a message
+const amqp10Timeout = 30 * time.Second
+
+// amqp10Publisher publishes messages with the AMQP 1.0 protocol (Azure Service Bus, ActiveMQ Artemis, RabbitMQ 4...)
+// AMQP 1.0 has no exchanges nor queue declarations: the messages are sent to the node named by the queue (--queue-prefix
+// could add the address prefix of the broker such as /amq/queue/) or to the exchange with the routing key as subject.
+// Each message waits for its settlement, a message rejected by the broker is reported as nacked.
+type amqp10Publisher struct {
+	conn    *amqp10.Conn
+	session *amqp10.Session
+	lock    sync.Mutex                // Protects senders and closed
+	senders map[string]*amqp10.Sender // Link by address, attached on the first message
+	closed  bool
+	noReturns
+}
+
+// newAMQP10Publisher connects to the url, its path is the vhost sent as the hostname (vhost:name) as RabbitMQ expects
+func newAMQP10Publisher(rawURL string) (*amqp10Publisher, error) {
+	address, options, err := amqp10ConnOptions(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), amqp10Timeout)
+	defer cancel()
+	conn, err := amqp10.Dial(ctx, address, options)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &amqp10Publisher{conn: conn, session: session, senders: make(map[string]*amqp10.Sender)}, nil
+}
+
+// amqp10ConnOptions splits the vhost from the url and sets the TLS configuration of the amqps urls
+func amqp10ConnOptions(rawURL string) (string, *amqp10.ConnOptions, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	options := &amqp10.ConnOptions{}
+	if parsed.Scheme == "amqps" {
+		options.TLSConfig = &tls.Config{}
+		if tlsConfig != nil {
+			options.TLSConfig = tlsConfig.Clone()
+		}
+		if options.TLSConfig.ServerName == "" {
+			// The hostname could be replaced by the vhost, so the certificate is verified against the host
+			options.TLSConfig.ServerName = parsed.Hostname()
+		}
+	}
+	if vhost := strings.TrimPrefix(parsed.Path, "/"); vhost != "" {
+		options.HostName = "vhost:" + vhost
+	}
+	parsed.Path, parsed.RawPath = "", ""
+	return parsed.String(), options, nil
+}
+
+// sender returns the link sending to address, it is attached if needed
+func (p *amqp10Publisher) sender(address string) (*amqp10.Sender, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("The AMQP 1.0 publisher is closed")
+	}
+	if sender, ok := p.senders[address]; ok {
+		return sender, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), amqp10Timeout)
+	defer cancel()
+	sender, err := p.session.NewSender(ctx, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.senders[address] = sender
+	return sender, nil
+}
+
+func (p *amqp10Publisher) Publish(exchange, routingKey string, mandatory, immediate bool, msg amqp.Publishing) error {
+	address, message := amqp10Message(exchange, routingKey, msg)
+	sender, err := p.sender(address)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), amqp10Timeout)
+	defer cancel()
+	err = sender.Send(ctx, message, nil)
+	if _, rejected := err.(*amqp10.Error); rejected {
+		return errNacked{exchange, routingKey}
+	}
+	if err != nil {
+		// The link could not be used anymore, it is attached again by the next message
+		p.lock.Lock()
+		delete(p.senders, address)
+		p.lock.Unlock()
+	}
+	return err
+}
+
+// amqp10Message converts a message published with AMQP 0-9-1 and returns the address where it should be sent
+func amqp10Message(exchange, routingKey string, msg amqp.Publishing) (string, *amqp10.Message) {
+	result := amqp10.NewMessage(msg.Body)
+	result.Header = &amqp10.MessageHeader{Durable: msg.DeliveryMode == amqp.Persistent, Priority: msg.Priority}
+	if msg.Priority == 0 {
+		// 0 is the absence of priority in AMQP 0-9-1, 4 is the default priority of AMQP 1.0
+		result.Header.Priority = 4
+	}
+	if ttl, err := strconv.Atoi(msg.Expiration); err == nil && ttl > 0 {
+		result.Header.TTL = time.Duration(ttl) * time.Millisecond
+	}
+	properties := &amqp10.MessageProperties{}
+	optional := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return &value
+	}
+	address := routingKey
+	if exchange != "" {
+		address, properties.Subject = exchange, optional(routingKey)
+	}
+	properties.To = &address
+	if msg.MessageId != "" {
+		properties.MessageID = msg.MessageId
+	}
+	if msg.CorrelationId != "" {
+		properties.CorrelationID = msg.CorrelationId
+	}
+	if msg.UserId != "" {
+		properties.UserID = []byte(msg.UserId)
+	}
+	properties.ReplyTo = optional(msg.ReplyTo)
+	properties.ContentType = optional(msg.ContentType)
+	properties.ContentEncoding = optional(msg.ContentEncoding)
+	if !msg.Timestamp.IsZero() {
+		properties.CreationTime = &msg.Timestamp
+	}
+	result.Properties = properties
+	if len(msg.Headers) > 0 {
+		result.ApplicationProperties = make(map[string]interface{}, len(msg.Headers))
+		for key, value := range msg.Headers {
+			result.ApplicationProperties[key] = amqp10Value(value)
+		}
+	}
+	return address, result
+}
+
+// amqp10Value converts a header value, the application properties of AMQP 1.0 only accept simple values so the
+// tables, arrays and decimals are converted to their text
+func amqp10Value(value interface{}) interface{} {
+	switch value.(type) {
+	case nil, bool, string, []byte, int8, int16, int32, int64, uint8, uint16, uint32, uint64, float32, float64, time.Time:
+		return value
+	}
+	return fmt.Sprint(value)
+}
+
+// DeclareQueue does nothing since the nodes of AMQP 1.0 are managed by the broker
+func (p *amqp10Publisher) DeclareQueue(name string, args amqp.Table) error {
+	return nil
+}
+
+// DeclareExchange does nothing since the nodes of AMQP 1.0 are managed by the broker
+func (p *amqp10Publisher) DeclareExchange(name string) (bool, error) {
+	return false, nil
+}
+
+func (p *amqp10Publisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), amqp10Timeout)
+	defer cancel()
+	for _, sender := range p.senders {
+		sender.Close(ctx)
+	}
+	p.senders, p.closed = nil, true
+	p.session.Close(ctx)
+	p.closeReturns()
+	return p.conn.Close()
+}
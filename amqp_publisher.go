@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher abstracts the protocol used to publish the recovered messages
+type Publisher interface {
+	// Publish sends a message to the exchange (or to the queue named by routingKey if exchange is empty)
+	Publish(exchange, routingKey string, mandatory, immediate bool, msg amqp.Publishing) error
+	// DeclareQueue ensures that a durable queue exists, args are the optional queue arguments (x-max-priority...)
+	// The publisher remains usable if the queue already exists with different properties (see isDeclareConflict).
+	DeclareQueue(name string, args amqp.Table) error
+	// DeclareExchange ensures that a durable exchange exists, missing exchanges are declared as topic exchanges
+	// It returns true if the exchange has been declared.
+	DeclareExchange(name string) (bool, error)
+	// NotifyReturn registers a channel receiving the unroutable mandatory messages
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	// Close releases the connection to the broker
+	Close() error
+}
+
+// Values of --protocol
+const (
+	protocolAMQP    = "amqp"
+	protocolAMQPS   = "amqps"
+	protocolAMQP10  = "amqp10"  // AMQP 1.0 endpoint
+	protocolAMQPS10 = "amqps10" // AMQP 1.0 endpoint over TLS (Azure Service Bus...)
+)
+
+// isAMQP10 determines if the protocol publishes with AMQP 1.0
+func isAMQP10(protocol string) bool {
+	return protocol == protocolAMQP10 || protocol == protocolAMQPS10
+}
+
+// protocolScheme returns the url scheme of the protocol
+func protocolScheme(protocol string) string {
+	switch protocol {
+	case protocolAMQP10:
+		return protocolAMQP
+	case protocolAMQPS10:
+		return protocolAMQPS
+	}
+	return protocol
+}
+
+// newPublisher connects a publisher to the vhost (the one of the url if empty) of the target cluster using the protocol selected in the options
+func newPublisher(options publisherOptions, target int, vhost string) (Publisher, error) {
+	if err := checkSink(options.sink, options.kafka); err != nil {
+		return nil, err
+	}
+	if options.sink == sinkKafka {
+		return newKafkaPublisher(options.kafka)
+	}
+	if isAMQP10(options.protocol) {
+		return newAMQP10Publisher(options.vhostURL(target, vhost))
+	}
+	return newAMQP091Publisher(options.vhostURL(target, vhost), options.confirm)
+}
+
+// noReturns implements NotifyReturn for the protocols that never return the unroutable messages (the broker rejects
+// them), the channels are closed with the publisher
+type noReturns struct {
+	lock    sync.Mutex
+	returns []chan amqp.Return
+	closed  bool
+}
+
+func (r *noReturns) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		close(returns)
+	} else {
+		r.returns = append(r.returns, returns)
+	}
+	return returns
+}
+
+// closeReturns closes the registered channels and the channels registered later
+func (r *noReturns) closeReturns() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, returns := range r.returns {
+		close(returns)
+	}
+	r.returns, r.closed = nil, true
+}
+
+// errNacked is returned by Publish when the broker has not accepted the message (publisher confirms only)
+type errNacked struct {
+	exchange, routingKey string
+}
+
+func (e errNacked) Error() string {
+	return fmt.Sprintf("Message published to %s has been nacked by the broker", publishedTo(e.exchange, e.routingKey))
+}
+
+// publishedTo describes where a message is published, the queue named by routingKey if exchange is empty
+func publishedTo(exchange, routingKey string) string {
+	if exchange == "" {
+		return routingKey
+	}
+	return fmt.Sprintf("%s (routing key %q)", exchange, routingKey)
+}
+
+// isNacked determines if a publish failed because the broker refused the message
+func isNacked(err error) bool {
+	_, nacked := err.(errNacked)
+	return nacked
+}
+
+// amqp091Publisher publishes messages with the AMQP 0-9-1 protocol
+type amqp091Publisher struct {
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation // Set if the channel is in confirm mode
+	lock     sync.Mutex             // Pairs each publish with its confirmation
+}
+
+// newAMQP091Publisher connects to the url, if confirm is set each publish waits for the confirmation of the broker
+func newAMQP091Publisher(url string, confirm bool) (*amqp091Publisher, error) {
+	conn, err := dialAMQP(url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil && confirm {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	publisher := &amqp091Publisher{conn: conn, ch: ch}
+	if confirm {
+		publisher.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+	return publisher, nil
+}
+
+func (p *amqp091Publisher) Publish(exchange, routingKey string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if p.confirms == nil {
+		return p.ch.Publish(exchange, routingKey, mandatory, immediate, msg)
+	}
+	// The messages are published one at a time, so the next confirmation is the one of the message
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.ch.Publish(exchange, routingKey, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	confirmation, ok := <-p.confirms
+	if !ok {
+		return fmt.Errorf("The channel has been closed before the message published to %s was confirmed", publishedTo(exchange, routingKey))
+	}
+	if !confirmation.Ack {
+		return errNacked{exchange, routingKey}
+	}
+	return nil
+}
+
+func (p *amqp091Publisher) DeclareQueue(name string, args amqp.Table) error {
+	// The broker closes the channel if the queue exists with different properties, so a temporary channel is used
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	if _, err = ch.QueueDeclare(name, true, false, false, false, args); err == nil {
+		ch.Close()
+	}
+	return err
+}
+
+// isDeclareConflict determines if a declaration failed because the queue already exists with different properties
+func isDeclareConflict(err error) bool {
+	amqpErr, ok := err.(*amqp.Error)
+	return ok && amqpErr.Code == amqp.PreconditionFailed
+}
+
+func (p *amqp091Publisher) DeclareExchange(name string) (bool, error) {
+	// The broker closes the channel of a passive declaration if the exchange does not exist, so a probe channel is used
+	probe, err := p.conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	if err := probe.ExchangeDeclarePassive(name, amqp.ExchangeTopic, true, false, false, false, nil); err == nil {
+		probe.Close()
+		return false, nil
+	}
+	// The probe has been closed by the broker, the exchange is declared on another temporary channel since the broker
+	// also closes the channel if the exchange has been declared meanwhile with a different type
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return true, err
+	}
+	if err = ch.ExchangeDeclare(name, amqp.ExchangeTopic, true, false, false, false, nil); err == nil {
+		ch.Close()
+	}
+	return true, err
+}
+
+func (p *amqp091Publisher) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	return p.ch.NotifyReturn(returns)
+}
+
+func (p *amqp091Publisher) Close() error {
+	p.ch.Close()
+	err := p.conn.Close()
+	if p.confirms != nil {
+		// The confirmation channel is closed once the channel is shut down, the pending confirmations are discarded
+		for range p.confirms {
+		}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Encodings of the message bodies written in the output files
+const (
+	bodyBase64 = "base64"
+	bodyHex    = "hex"
+	bodyRaw    = "raw" // Quoted string with Go escaping, so a body always fits on a single line
+	bodyAuto   = "auto"
+	bodyBinary = "binary" // Length delimited records with a checksum instead of lines (see exportRecord)
+)
+
+// base64Variants are the alphabets supported by --base64-variant, raw variants have no padding
+var base64Variants = map[string]*base64.Encoding{
+	"std":     base64.StdEncoding,
+	"url":     base64.URLEncoding,
+	"raw-std": base64.RawStdEncoding,
+	"raw-url": base64.RawURLEncoding,
+}
+
+// base64Body is the alphabet used to encode and decode the base64 bodies (set by --base64-variant)
+var base64Body = base64.StdEncoding
+
+// encodeBody converts a message body to the requested output encoding
+func encodeBody(encoding string, data []byte) string {
+	switch encoding {
+	case bodyHex:
+		return hex.EncodeToString(data)
+	case bodyRaw:
+		return strconv.Quote(string(data))
+	default:
+		return base64Body.EncodeToString(data)
+	}
+}
+
+// decodeBody converts a line produced by encodeBody back to the message body
+// With auto, quoted lines are considered as raw, lines only made of hexadecimal digits as hex and all others as base64.
+func decodeBody(encoding string, line string) ([]byte, error) {
+	if encoding == bodyBinary {
+		// Binary records are not encoded, the body may end with a line feed
+		return []byte(line), nil
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if encoding == bodyAuto {
+		encoding = bodyBase64
+		if strings.HasPrefix(line, `"`) {
+			encoding = bodyRaw
+		} else if isHex(line) {
+			encoding = bodyHex
+		}
+	}
+	switch encoding {
+	case bodyHex:
+		return hex.DecodeString(line)
+	case bodyRaw:
+		value, err := strconv.Unquote(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid raw body: %v", err)
+		}
+		return []byte(value), nil
+	default:
+		return base64Body.DecodeString(line)
+	}
+}
+
+func isHex(line string) bool {
+	if line == "" || len(line)%2 != 0 {
+		return false
+	}
+	for _, c := range line {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// maxBinaryRecord is the largest body accepted in a binary record, a larger length denotes a corrupted record
+const maxBinaryRecord = 512 << 20
+
+// exportRecord returns a message body as written in the export files: an encoded line, or with binary, a length
+// delimited record ([uint32 length][body][uint32 crc32 of the body], big endian)
+func exportRecord(encoding string, data []byte) string {
+	if encoding != bodyBinary {
+		return encodeBody(encoding, data) + "\n"
+	}
+	record := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	binary.BigEndian.PutUint32(record[4+len(data):], crc32.ChecksumIEEE(data))
+	return string(record)
+}
+
+// corruptRecord is returned for a binary record whose checksum does not match or that is truncated
+// The reading could continue with the following record unless the record is truncated.
+type corruptRecord struct {
+	reason    string
+	truncated bool
+}
+
+func (e corruptRecord) Error() string { return e.reason }
+
+// readRecord reads the next record of an export file: a line (with its line feed) or with binary, the body of a
+// length delimited record. size is the number of bytes consumed from the reader.
+func readRecord(reader *bufio.Reader, encoding string) (record string, size int, err error) {
+	if encoding != bodyBinary {
+		line, err := reader.ReadString('\n')
+		return line, len(line), err
+	}
+
+	var header [4]byte
+	if size, err = io.ReadFull(reader, header[:]); err == io.EOF {
+		return "", 0, io.EOF
+	} else if err != nil {
+		return "", size, corruptRecord{fmt.Sprintf("Truncated record length (%d bytes)", size), true}
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxBinaryRecord {
+		return "", size, corruptRecord{fmt.Sprintf("Invalid record length %d", length), true}
+	}
+	data := make([]byte, length+4)
+	read, err := io.ReadFull(reader, data)
+	size += read
+	if err != nil {
+		return "", size, corruptRecord{fmt.Sprintf("Truncated record (%d of %d bytes)", read, len(data)), true}
+	}
+	body := data[:length]
+	if expected, actual := binary.BigEndian.Uint32(data[length:]), crc32.ChecksumIEEE(body); expected != actual {
+		return "", size, corruptRecord{fmt.Sprintf("Invalid checksum %08x (expected %08x) for a record of %d bytes", actual, expected, length), false}
+	}
+	return string(body), size, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		encoding, line, want string
+	}{
+		// A base64 body only made of hexadecimal digits is only taken for hex when the encoding is detected
+		{bodyBase64, "cafebabe", "q\xa7\xdem\xa6\xde"},
+		{bodyAuto, "cafebabe", "\xca\xfe\xba\xbe"},
+		{bodyAuto, `"hello\n"`, "hello\n"},
+		{bodyAuto, "aGVsbG8=\r\n", "hello"},
+		{bodyHex, "68656c6c6f", "hello"},
+		{bodyRaw, `"hello"`, "hello"},
+	}
+	for _, test := range tests {
+		got, err := decodeBody(test.encoding, test.line)
+		if err != nil || string(got) != test.want {
+			t.Errorf("decodeBody(%s, %q) = %q, %v, expected %q", test.encoding, test.line, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// bodyTransform replaces a literal value or a regular expression in the message bodies before replay
+type bodyTransform struct {
+	old         []byte
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+// parseBodyTransforms converts old=new definitions into transforms (the first = separates the values)
+func parseBodyTransforms(definitions []string, isRegex bool) ([]bodyTransform, error) {
+	var transforms []bodyTransform
+	for _, definition := range definitions {
+		parts := strings.SplitN(definition, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid body replacement %q, expected old=new", definition)
+		}
+		transform := bodyTransform{old: []byte(parts[0]), replacement: []byte(parts[1])}
+		if isRegex {
+			re, err := regexp.Compile(parts[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid body replacement %q: %v", definition, err)
+			}
+			transform.re = re
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms, nil
+}
+
+// Apply returns the transformed body
+func (t bodyTransform) Apply(data []byte) []byte {
+	if t.re != nil {
+		return t.re.ReplaceAll(data, t.replacement)
+	}
+	return bytes.Replace(data, t.old, t.replacement, -1)
+}
+
+// transformBody applies all transforms to the message body and returns whether it has been modified
+// The original message data is left untouched.
+func (options publisherOptions) transformBody(msg *RabbitMessage) ([]byte, bool) {
+	data := msg.Data
+	for _, transform := range options.transforms {
+		data = transform.Apply(data)
+	}
+	return data, len(options.transforms) > 0 && !bytes.Equal(data, msg.Data)
+}
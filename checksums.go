@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+const checksumFile = "checksums.sha256"
+
+// checksumManifest retains the sha256 of the files written in an output folder
+// The manifest uses the sha256sum format, so it could also be verified with sha256sum -c.
+type checksumManifest struct {
+	folder string
+	sums   map[string]string
+}
+
+func newChecksumManifest(folder string) *checksumManifest {
+	return &checksumManifest{folder: folder, sums: make(map[string]string)}
+}
+
+// Add computes the checksum of a closed file (nothing is done if the manifest is nil)
+func (c *checksumManifest) Add(fileName string) {
+	if c == nil {
+		return
+	}
+	rel := must(filepath.Rel(c.folder, fileName)).(string)
+	c.sums[filepath.ToSlash(rel)] = must(sha256File(fileName)).(string)
+}
+
+// Remove excludes a file that has been deleted from the manifest
+func (c *checksumManifest) Remove(fileName string) {
+	if c == nil {
+		return
+	}
+	delete(c.sums, filepath.ToSlash(must(filepath.Rel(c.folder, fileName)).(string)))
+}
+
+// Write saves the manifest in the output folder
+func (c *checksumManifest) Write() {
+	if c == nil {
+		return
+	}
+	names := make([]string, 0, len(c.sums))
+	for name := range c.sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fileName := filepath.Join(c.folder, checksumFile)
+	file := must(os.Create(fileName)).(*os.File)
+	defer file.Close()
+	for _, name := range names {
+		must(fmt.Fprintf(file, "%s  %s\n", c.sums[name], name))
+	}
+	errPrintln(color.GreenString("Checksums of %d files written to %s", len(names), fileName))
+}
+
+func sha256File(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyChecksums recomputes the checksums of the files listed in the manifest of the folder
+// It returns false if any file is missing or has been modified.
+func verifyChecksums(folder string) bool {
+	sums := must(readChecksums(folder)).(map[string]string)
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := getTable("File", "Status")
+	var verified, failed int
+	for _, name := range names {
+		sum, err := sha256File(filepath.Join(folder, filepath.FromSlash(name)))
+		switch {
+		case os.IsNotExist(err):
+			table.Append([]string{name, "Missing"})
+			failed++
+		case err != nil:
+			table.Append([]string{name, err.Error()})
+			failed++
+		case sum != sums[name]:
+			table.Append([]string{name, "Mismatch"})
+			failed++
+		default:
+			verified++
+		}
+	}
+
+	if failed > 0 {
+		table.Render()
+		fmt.Println()
+		errPrintln(color.RedString("%d of %d files do not match %s", failed, failed+verified, checksumFile))
+		return false
+	}
+	errPrintln(color.GreenString("All %d files match %s", verified, checksumFile))
+	return true
+}
+
+// readChecksums loads the manifest of a folder, the checksums are indexed by the slash separated path of the files
+func readChecksums(folder string) (map[string]string, error) {
+	file, err := os.Open(filepath.Join(folder, checksumFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if parts := strings.SplitN(scanner.Text(), "  ", 2); len(parts) == 2 {
+			sums[parts[1]] = parts[0]
+		}
+	}
+	return sums, scanner.Err()
+}
+
+// Values of --on-checksum-mismatch
+const (
+	checksumFail = "fail" // Nothing is replayed
+	checksumSkip = "skip" // The file is not replayed
+	checksumWarn = "warn" // The file is replayed anyway
+)
+
+// checkInputChecksums verifies the input files against the manifest of their folder before they are replayed
+// Files of folders without manifest are kept as is. It returns the files to replay according to onMismatch, or
+// false if the replay must be refused.
+func checkInputChecksums(folders, files []string, onMismatch string) ([]string, bool) {
+	manifests := make(map[string]map[string]string)
+	for _, folder := range folders {
+		folder = must(filepath.Abs(folder)).(string)
+		sums, err := readChecksums(folder)
+		if err != nil && !os.IsNotExist(err) {
+			errPrintln(color.RedString("Unable to read %s: %v", filepath.Join(folder, checksumFile), err))
+			return nil, false
+		}
+		manifests[folder] = sums
+	}
+
+	result := make([]string, 0, len(files))
+	var verified, failed int
+	for _, file := range files {
+		folder, name := manifestEntryOf(manifests, file)
+		if folder == "" {
+			result = append(result, file)
+			continue
+		}
+		expected, listed := manifests[folder][name]
+		if !listed {
+			errPrintln(color.YellowString("%s is not listed in %s, its checksum has not been verified", file, filepath.Join(folder, checksumFile)))
+			result = append(result, file)
+			continue
+		}
+		if sum, err := sha256File(file); err == nil && sum == expected {
+			verified++
+			result = append(result, file)
+			continue
+		}
+		failed++
+		switch onMismatch {
+		case checksumWarn:
+			errPrintln(color.YellowString("%s does not match %s, it is replayed anyway", file, checksumFile))
+			result = append(result, file)
+		case checksumSkip:
+			errPrintln(color.RedString("%s does not match %s, it is skipped", file, checksumFile))
+		default:
+			errPrintln(color.RedString("%s does not match %s", file, checksumFile))
+		}
+	}
+	if failed > 0 {
+		errPrintln(color.RedString("%d of %d input files do not match %s", failed, failed+verified, checksumFile))
+	} else if verified > 0 {
+		errPrintln(color.GreenString("All %d input files match %s", verified, checksumFile))
+	}
+	return result, failed == 0 || onMismatch != checksumFail
+}
+
+// manifestEntryOf returns the folder whose manifest covers the file and the name of the file in this manifest
+// An empty folder is returned if the file is not in a folder with a manifest.
+func manifestEntryOf(manifests map[string]map[string]string, file string) (string, string) {
+	abs := must(filepath.Abs(file)).(string)
+	for folder, sums := range manifests {
+		if rel, err := filepath.Rel(folder, abs); sums != nil && err == nil && !strings.HasPrefix(rel, "..") {
+			return folder, filepath.ToSlash(rel)
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressNone = "none"
+	compressZstd = "zstd"
+	zstdExt      = ".zst"
+	gzipExt      = ".gz"
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gzipMagic = []byte{0x1f, 0x8b, 0x08} // Gzip identification followed by the deflate method
+)
+
+// compressionExts are the extensions of the compressed files that are read transparently
+var compressionExts = []string{zstdExt, gzipExt}
+
+// outputCompression is the compression applied to the files written by find-lost and split-messages
+var outputCompression = compressNone
+
+// trimCompressionExt returns the name of a file without its compression extension
+func trimCompressionExt(fileName string) string {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(fileName, ext) {
+			return strings.TrimSuffix(fileName, ext)
+		}
+	}
+	return fileName
+}
+
+// isZstd determines if the file is compressed with zstd by looking at its suffix or its magic bytes
+func isZstd(fileName string, header []byte) bool {
+	return strings.HasSuffix(fileName, zstdExt) || bytes.HasPrefix(header, zstdMagic)
+}
+
+// isGzip determines if the file is compressed with gzip by looking at its suffix or its magic bytes
+func isGzip(fileName string, header []byte) bool {
+	return strings.HasSuffix(fileName, gzipExt) || bytes.HasPrefix(header, gzipMagic)
+}
+
+// decompressData returns the uncompressed content of a file if it is compressed
+func decompressData(fileName string, data []byte) ([]byte, error) {
+	if isGzip(fileName, data) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	}
+	if !isZstd(fileName, data) {
+		return data, nil
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
+
+// openDecompressed returns a reader of the uncompressed content of a file and whether the file is compressed
+func openDecompressed(file *os.File) (*bufio.Reader, bool) {
+	return decompressReader(file.Name(), file)
+}
+
+// decompressReader returns a reader of the uncompressed content of the file name read by reader and whether it is
+// compressed
+func decompressReader(name string, input io.Reader) (*bufio.Reader, bool) {
+	reader := bufio.NewReader(input)
+	header, _ := reader.Peek(len(zstdMagic))
+	if isGzip(name, header) {
+		return bufio.NewReader(must(gzip.NewReader(reader)).(*gzip.Reader)), true
+	}
+	if !isZstd(name, header) {
+		return reader, false
+	}
+	return bufio.NewReader(must(zstd.NewReader(reader)).(*zstd.Decoder)), true
+}
+
+// outputFile is a file written by find-lost or split-messages, compressed according to outputCompression
+type outputFile struct {
+	file    *os.File
+	writer  io.Writer
+	encoder *zstd.Encoder
+}
+
+func newOutputFile(fileName string) (*outputFile, error) {
+	if outputCompression == compressZstd {
+		fileName += zstdExt
+	}
+	return openOutputFile(fileName, os.O_TRUNC)
+}
+
+// reopenOutputFile opens a file created by newOutputFile (name includes the compression extension) to add messages
+// Compressed messages are added in a new zstd frame, which is read back as a continuation of the previous ones.
+func reopenOutputFile(name string) (*outputFile, error) { return openOutputFile(name, os.O_APPEND) }
+
+func openOutputFile(fileName string, mode int) (*outputFile, error) {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|mode, 0666)
+	if err != nil {
+		return nil, err
+	}
+	output := &outputFile{file: file, writer: file}
+	if outputCompression == compressZstd {
+		if output.encoder, err = zstd.NewWriter(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		output.writer = output.encoder
+	}
+	return output, nil
+}
+
+// Name returns the name of the file on disk (including the compression extension)
+func (o *outputFile) Name() string { return o.file.Name() }
+
+// WriteString writes a value to the file
+func (o *outputFile) WriteString(value string) (int, error) { return io.WriteString(o.writer, value) }
+
+// Close flushes the compressed data and closes the file
+func (o *outputFile) Close() error {
+	if o.encoder != nil {
+		if err := o.encoder.Close(); err != nil {
+			o.file.Close()
+			return err
+		}
+	}
+	return o.file.Close()
+}
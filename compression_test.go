@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReadCompressedFile(t *testing.T) {
+	for name, read := range map[string]func(string) (RabbitFile, error){
+		"loaded":   func(file string) (RabbitFile, error) { return ReadRabbitFile(file, nil) },
+		"streamed": func(file string) (RabbitFile, error) { return ReadRabbitFileStreaming(file, nil) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			file, err := read("testdata/1.rdq.gz")
+			if err != nil {
+				t.Fatalf("Unable to read the file: %v", err)
+			}
+			var messages []string
+			file.ProcessMessages(func(msg *RabbitMessage) { messages = append(messages, msg.Queue+": "+string(msg.Data)) })
+			expected := []string{"q.one: first message", "q.two: part 1 and part 2"}
+			if fmt.Sprint(messages) != fmt.Sprint(expected) {
+				t.Errorf("Got %q, expected %q", messages, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// deadLetters writes the messages that could not be published in a file per queue of a folder, in the format of the
+// files exported by find-lost, so they could be replayed later with the replay command
+// It is safe for concurrent use, a nil deadLetters discards the messages.
+type deadLetters struct {
+	folder   string
+	encoding string
+	lock     sync.Mutex
+	outputs  *outputCache
+	written  int
+}
+
+func newDeadLetters(folder, encoding string) *deadLetters {
+	return &deadLetters{folder: folder, encoding: encoding, outputs: newOutputCache(0)}
+}
+
+// Write adds the body of a message to the file of its queue
+func (d *deadLetters) Write(queue string, body []byte) error {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.written == 0 {
+		if err := os.MkdirAll(d.folder, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if queue == unknownQueue {
+		queue = unknownBucket
+	}
+	file, err := d.outputs.Get(filepath.Join(d.folder, queue))
+	if err == nil {
+		_, err = file.WriteString(exportRecord(d.encoding, body))
+	}
+	if err == nil {
+		d.written++
+	}
+	return err
+}
+
+// Close closes the files and reports the number of messages written
+func (d *deadLetters) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.written > 0 {
+		errPrintln(color.YellowString("%d message(s) that could not be published written to %s", d.written, d.folder))
+	}
+	return d.outputs.Close()
+}
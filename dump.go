@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// dumpRecord represents the information written for each message by the dump command
+type dumpRecord struct {
+	File        string            `json:"file"`
+	Position    int               `json:"position"`
+	Queue       string            `json:"queue"`
+	Size        int               `json:"size"`
+	Push        bool              `json:"push"`
+	Method      string            `json:"method"`
+	Encoding    string            `json:"encoding"`
+	ContentType string            `json:"content_type,omitempty"`
+	MessageID   string            `json:"message_id,omitempty"`
+	Timestamp   string            `json:"timestamp,omitempty"`
+	CMF         map[string]string `json:"cmf,omitempty"`
+	Body        string            `json:"body,omitempty"`
+}
+
+// dumpColumns are the CSV columns, the cmf column is only written with --inspect-cmf and the body is always the last one
+var dumpColumns = []string{"file", "position", "queue", "size", "push", "method", "encoding", "content_type", "message_id", "timestamp", "cmf", "body"}
+
+func newDumpRecord(file string, msg *RabbitMessage, withBody bool, encoding string) dumpRecord {
+	record := dumpRecord{
+		File:     file,
+		Position: msg.Position,
+		Queue:    msg.Queue,
+		Size:     len(msg.Data),
+		Push:     msg.IsPush(),
+		Method:   msg.Method,
+		Encoding: msg.Encoding(),
+		CMF:      msg.CMF,
+	}
+	if props := msg.Properties; props != nil {
+		record.ContentType = props.ContentType
+		record.MessageID = props.MessageID
+		if !props.Timestamp.IsZero() {
+			record.Timestamp = props.Timestamp.UTC().Format(time.RFC3339)
+		}
+	}
+	if withBody {
+		record.Body = encodeBody(encoding, msg.Data)
+	}
+	return record
+}
+
+func (r dumpRecord) csvRow(withBody bool) []string {
+	row := []string{r.File, fmt.Sprint(r.Position), r.Queue, fmt.Sprint(r.Size), fmt.Sprint(r.Push), r.Method, r.Encoding, r.ContentType, r.MessageID, r.Timestamp, formatCMF(r.CMF), r.Body}
+	return dumpRow(row, withBody)
+}
+
+// dumpRow removes the optional columns from a CSV row (or from the header)
+func dumpRow(row []string, withBody bool) []string {
+	if !inspectCMF {
+		row = append(append([]string{}, row[:len(row)-2]...), row[len(row)-1])
+	}
+	if !withBody {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+// messageDumper writes message records as JSON lines, CSV or binary records
+// When withBody is false, the message body is never written. The binary format only contains the bodies.
+type messageDumper struct {
+	csv      *csv.Writer
+	json     *json.Encoder
+	binary   io.Writer
+	withBody bool
+	encoding string
+}
+
+func newMessageDumper(writer io.Writer, format string, withBody bool, encoding string) *messageDumper {
+	dumper := &messageDumper{withBody: withBody, encoding: encoding}
+	if format == bodyBinary {
+		dumper.binary = writer
+	} else if format == "csv" {
+		dumper.csv = csv.NewWriter(writer)
+		must(dumper.csv.Write(dumpRow(dumpColumns, withBody)))
+	} else {
+		dumper.json = json.NewEncoder(writer)
+	}
+	return dumper
+}
+
+// Write outputs the record of a message found in file
+func (d *messageDumper) Write(file string, msg *RabbitMessage) {
+	if d.binary != nil {
+		must(io.WriteString(d.binary, exportRecord(bodyBinary, msg.Data)))
+		return
+	}
+	record := newDumpRecord(file, msg, d.withBody, d.encoding)
+	if d.csv != nil {
+		must(d.csv.Write(record.csvRow(d.withBody)))
+	} else {
+		must(d.json.Encode(record))
+	}
+}
+
+// Flush ensures that all records are written
+func (d *messageDumper) Flush() {
+	if d.csv != nil {
+		d.csv.Flush()
+		must(d.csv.Error())
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// rawExt is the extension of the files written by export-raw
+const rawExt = ".bin"
+
+// rawFileName returns the name of the file where export-raw writes a message: <queue>-<fileno>-<position>.bin
+// The file number is the name of the segment without its extensions.
+func rawFileName(file string, msg *RabbitMessage) string {
+	queue := msg.Queue
+	if queue == unknownQueue {
+		queue = unknownBucket
+	}
+	base := path.Base(trimCompressionExt(file))
+	return fmt.Sprintf("%s-%s-%d%s", queue, strings.TrimSuffix(base, path.Ext(base)), msg.Position, rawExt)
+}
+
+// exportRawMessages parses the files with the parsers of the full command and writes each message body untouched in
+// its own file of folder, it returns the number of files written
+// The messages of files having the same number (a segment and an index file for instance) are distinguished by the
+// type of their file.
+func exportRawMessages(files []string, folder string, threads int, reMatch *regexp.Regexp, join bool, sums *checksumManifest, progress *progressIndicator) int {
+	jobs := make(chan string, threads)
+	results := make(chan RabbitFile, threads)
+	if join {
+		sortSegments(files)
+		threads = 1
+	}
+	for i := 0; i < threads; i++ {
+		id := i
+		go withWorkerLabel("parser", id, func() { fileHandler(id, jobs, results, reMatch, join) })
+	}
+	go func() {
+		for _, file := range files {
+			jobs <- file
+		}
+		close(jobs)
+	}()
+
+	written := 0
+	names := make(map[string]string)
+	for range files {
+		data := <-results
+		progress.Add(data.Count(), data.Size())
+		for _, msg := range data.Messages {
+			name := rawFileName(data.Name(), msg)
+			if previous, exists := names[name]; exists && previous != data.Name() {
+				name = strings.TrimSuffix(name, rawExt) + "." + data.Type() + rawExt
+			}
+			names[name] = data.Name()
+			fileName := filepath.Join(folder, name)
+			if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+				abortWrite(fileName, err, written)
+			}
+			if err := ioutil.WriteFile(fileName, msg.Data, 0644); err != nil {
+				abortWrite(fileName, err, written)
+			}
+			sums.Add(fileName)
+			written++
+		}
+	}
+	errPrintln(color.GreenString("%d messages written to %s", written, folder))
+	return written
+}
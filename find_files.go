@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coveooss/gotemplate/v3/utils"
+	"github.com/fatih/color"
+)
+
+// unlimitedDepth is used when the user specify a max depth of 0 or less
+const unlimitedDepth = 1 << 16
+
+// findFiles returns the files matching the patterns in all folders without duplicates, maxDepth <= 0 meaning no limit
+func findFiles(folders []string, maxDepth int, patterns ...string) []string {
+	if len(folders) == 0 {
+		folders = []string{"."}
+	}
+	var result []string
+	found := make(map[string]bool)
+	for _, folder := range folders {
+		for _, file := range findFilesInFolder(folder, maxDepth, patterns...) {
+			if abs, _ := filepath.Abs(file); !found[abs] {
+				found[abs] = true
+				result = append(result, file)
+			}
+		}
+	}
+	return result
+}
+
+// findFilesInFolder returns the files matching the patterns in folder, maxDepth <= 0 meaning no limit
+// A warning is issued if some files are found at the maximum depth since deeper files may have been skipped.
+func findFilesInFolder(folder string, maxDepth int, patterns ...string) []string {
+	if maxDepth <= 0 {
+		maxDepth = unlimitedDepth
+	}
+	files := utils.MustFindFilesMaxDepth(folder, maxDepth, false, patterns...)
+	if maxDepth != unlimitedDepth {
+		root, _ := filepath.Abs(folder)
+		for _, file := range files {
+			file, _ = filepath.Abs(file)
+			if rel, err := filepath.Rel(root, file); err == nil && strings.Count(rel, string(filepath.Separator)) >= maxDepth {
+				errPrintln(color.YellowString("Files found at max depth %d (%s), deeper files may have been skipped, consider raising --max-depth", maxDepth, file))
+				break
+			}
+		}
+	}
+	return files
+}
+
+// rabbitExtensions contains the extensions of the files generated by RabbitMQ
+var rabbitExtensions = []string{".rdq", ".idx"}
+
+// hintPatterns warns the user if rabbit files exist in the folders while none matched the patterns
+func hintPatterns(folders []string, maxDepth int, patterns ...string) {
+	if len(folders) == 0 {
+		folders = []string{"."}
+	}
+	if maxDepth <= 0 {
+		maxDepth = unlimitedDepth
+	}
+	for _, ext := range rabbitExtensions {
+		var count int
+		for _, folder := range folders {
+			count += len(utils.MustFindFilesMaxDepth(folder, maxDepth, false, "*"+ext))
+		}
+		if count > 0 {
+			errPrintln(color.YellowString("Found %d %s files but your pattern only matches %s, try --pattern '*%s'", count, ext, strings.Join(patterns, ", "), ext))
+		}
+	}
+}
+
+// limitFiles sorts the files to keep a deterministic result and keeps only the first max files (max <= 0 means no limit)
+func limitFiles(files []string, max int) []string {
+	sort.Strings(files)
+	if max > 0 && len(files) > max {
+		errPrintln(color.YellowString("Processing only the first %d of %d files (--max-files), results do not cover the whole folder", max, len(files)))
+		return files[:max]
+	}
+	return files
+}
+
+// regularFiles removes the folders matched by the patterns
+func regularFiles(files []string) []string {
+	result := files[:0]
+	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || !info.IsDir() {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// segmentNumber returns the number of a segment file (12 for 12.rdq, 12.idx.zst or 12.rdq.gz), false if the name is not a number
+func segmentNumber(file string) (int, bool) {
+	base := filepath.Base(trimCompressionExt(file))
+	value, err := strconv.Atoi(strings.TrimSuffix(base, filepath.Ext(base)))
+	return value, err == nil
+}
+
+// sortSegments sorts the files by folder then by segment number, so messages spanning several segments could be joined
+func sortSegments(files []string) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if di, dj := filepath.Dir(files[i]), filepath.Dir(files[j]); di != dj {
+			return di < dj
+		}
+		ni, oki := segmentNumber(files[i])
+		nj, okj := segmentNumber(files[j])
+		if oki && okj && ni != nj {
+			return ni < nj
+		}
+		return files[i] < files[j]
+	})
+}
+
+// excludeFiles removes the files whose name (or path) matches one of the patterns, it returns the number of excluded files
+func excludeFiles(files []string, patterns ...string) ([]string, int) {
+	result := files[:0]
+	for _, file := range files {
+		excluded := false
+		for _, pattern := range patterns {
+			if matchBase, _ := filepath.Match(pattern, filepath.Base(file)); matchBase {
+				excluded = true
+				break
+			}
+			if matchPath, _ := filepath.Match(pattern, file); matchPath {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			result = append(result, file)
+		}
+	}
+	return result, len(files) - len(result)
+}
@@ -3,10 +3,13 @@ module github.com/dbman666/rabbit-message-replayer
 go 1.12
 
 require (
+	github.com/Azure/go-amqp v1.0.5
+	github.com/IBM/sarama v1.43.3
 	github.com/coveooss/gotemplate/v3 v3.3.1
 	github.com/coveooss/multilogger v0.2.1
 	github.com/coveord/kingpin/v2 v2.3.1
 	github.com/fatih/color v1.7.0
+	github.com/klauspost/compress v1.17.9
 	github.com/mattn/go-runewidth v0.0.0-20181218000649-703b5e6b11ae // indirect
 	github.com/olekukonko/tablewriter v0.0.1
 	github.com/streadway/amqp v0.0.0-20181205114330-a314942b2fd9
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/streadway/amqp"
+)
+
+// Sinks supported by --sink
+const (
+	sinkAMQP  = "amqp"
+	sinkKafka = "kafka"
+)
+
+// kafkaOptions holds the settings of the Kafka sink
+type kafkaOptions struct {
+	brokers []string
+	topics  map[string]string // Topic by queue name, the queue name is used if not mapped
+}
+
+// parseTopicMap reads the queue=topic definitions of --kafka-topic
+func parseTopicMap(definitions []string) (map[string]string, error) {
+	result := make(map[string]string, len(definitions))
+	for _, definition := range definitions {
+		parts := strings.SplitN(definition, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid topic mapping %q, expected queue=topic", definition)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+// checkSink returns an error if messages cannot be published to the sink
+func checkSink(sink string, options kafkaOptions) error {
+	if sink == sinkKafka && len(options.brokers) == 0 {
+		return fmt.Errorf("--kafka-brokers is required with --sink %s", sinkKafka)
+	}
+	return nil
+}
+
+// kafkaURL is the url of the target replaced by the brokers, so the summary reports them
+func kafkaURL(options kafkaOptions) string {
+	return sinkKafka + "://" + strings.Join(options.brokers, ",")
+}
+
+// kafkaPublisher publishes the messages to Kafka topics, the topic is the one mapped to the queue (or the exchange) by
+// --kafka-topic or the name of the queue, the routing key of the messages published to an exchange is their key
+// Kafka has no exchanges nor queue declarations and does not return the messages, each message waits for the
+// acknowledgement of all the in-sync replicas and a message refused by the brokers is reported as nacked.
+type kafkaPublisher struct {
+	producer sarama.SyncProducer
+	topics   map[string]string
+	noReturns
+}
+
+// newKafkaConfig returns the configuration of the producer
+func newKafkaConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.ClientID = "rabbit-message-replayer"
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true // Required by the synchronous producer
+	return config
+}
+
+// newKafkaPublisher connects a producer to the brokers
+func newKafkaPublisher(options kafkaOptions) (*kafkaPublisher, error) {
+	producer, err := sarama.NewSyncProducer(options.brokers, newKafkaConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaPublisher{producer: producer, topics: options.topics}, nil
+}
+
+// topic returns the topic of the queue, or of the exchange if exchange is not empty
+func (p *kafkaPublisher) topic(exchange, routingKey string) string {
+	name := routingKey
+	if exchange != "" {
+		name = exchange
+	}
+	if topic, ok := p.topics[name]; ok {
+		return topic
+	}
+	return name
+}
+
+func (p *kafkaPublisher) Publish(exchange, routingKey string, mandatory, immediate bool, msg amqp.Publishing) error {
+	_, _, err := p.producer.SendMessage(kafkaMessage(p.topic(exchange, routingKey), exchange, routingKey, msg))
+	if _, refused := err.(sarama.KError); refused {
+		// The brokers answered, the message would be refused again (too large, unknown topic, not authorized...)
+		return errNacked{exchange, routingKey}
+	}
+	return err
+}
+
+// kafkaMessage converts a message published with AMQP 0-9-1 to the topic, the headers are sent as Kafka headers
+func kafkaMessage(topic, exchange, routingKey string, msg amqp.Publishing) *sarama.ProducerMessage {
+	result := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(msg.Body)}
+	if exchange != "" && routingKey != "" {
+		result.Key = sarama.StringEncoder(routingKey)
+	}
+	if !msg.Timestamp.IsZero() {
+		result.Timestamp = msg.Timestamp
+	}
+	keys := make([]string, 0, len(msg.Headers))
+	for key := range msg.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		header := sarama.RecordHeader{Key: []byte(key)}
+		switch value := msg.Headers[key].(type) {
+		case []byte:
+			header.Value = value
+		case nil:
+		default:
+			header.Value = []byte(fmt.Sprint(value))
+		}
+		result.Headers = append(result.Headers, header)
+	}
+	return result
+}
+
+// DeclareQueue does nothing since the topics are created by the brokers (or an administrator)
+func (p *kafkaPublisher) DeclareQueue(name string, args amqp.Table) error {
+	return nil
+}
+
+// DeclareExchange does nothing since Kafka has no exchanges
+func (p *kafkaPublisher) DeclareExchange(name string) (bool, error) {
+	return false, nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	p.closeReturns()
+	return p.producer.Close()
+}
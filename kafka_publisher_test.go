@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/streadway/amqp"
+)
+
+func TestParseTopicMap(t *testing.T) {
+	topics, err := parseTopicMap([]string{"q.one=orders", "q.two=audit=v2"})
+	if err != nil || topics["q.one"] != "orders" || topics["q.two"] != "audit=v2" {
+		t.Errorf("parseTopicMap() = %v, %v", topics, err)
+	}
+	for _, definition := range []string{"q.one", "=orders", "q.one="} {
+		if _, err := parseTopicMap([]string{definition}); err == nil {
+			t.Errorf("The mapping %q should be rejected", definition)
+		}
+	}
+}
+
+func TestKafkaPublish(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	publisher := &kafkaPublisher{producer: producer, topics: map[string]string{"q.one": "orders"}}
+	expect := func(topic, key, headers string) mocks.MessageChecker {
+		return func(msg *sarama.ProducerMessage) error {
+			gotKey := ""
+			if msg.Key != nil {
+				gotKey = fmt.Sprint(msg.Key)
+			}
+			var gotHeaders []string
+			for _, header := range msg.Headers {
+				gotHeaders = append(gotHeaders, fmt.Sprintf("%s=%s", header.Key, header.Value))
+			}
+			value, _ := msg.Value.Encode()
+			if msg.Topic != topic || gotKey != key || fmt.Sprint(gotHeaders) != headers || string(value) != "hello" {
+				return fmt.Errorf("Got %s/%q %v %q, expected %s/%q %s", msg.Topic, gotKey, gotHeaders, value, topic, key, headers)
+			}
+			return nil
+		}
+	}
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(expect("orders", "", "[cmf={url:q.one} count=3 raw=bytes]"))
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(expect("q.two", "", "[]"))
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(expect("events", "user.created", "[]"))
+	producer.ExpectSendMessageAndFail(sarama.ErrMessageSizeTooLarge)
+
+	headers := amqp.Table{"count": int32(3), "raw": []byte("bytes"), "cmf": "{url:q.one}"}
+	for _, test := range []struct {
+		exchange, routingKey string
+		headers              amqp.Table
+	}{{"", "q.one", headers}, {"", "q.two", nil}, {"events", "user.created", nil}} {
+		if err := publisher.Publish(test.exchange, test.routingKey, true, false, amqp.Publishing{Headers: test.headers, Body: []byte("hello")}); err != nil {
+			t.Errorf("Publish(%s, %s) failed: %v", test.exchange, test.routingKey, err)
+		}
+	}
+	if err := publisher.Publish("", "q.one", true, false, amqp.Publishing{Body: []byte("hello")}); !isNacked(err) {
+		t.Errorf("A message refused by the brokers should be nacked, got %v", err)
+	}
+
+	returns := publisher.NotifyReturn(make(chan amqp.Return, 1))
+	if err := publisher.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	if _, open := <-returns; open {
+		t.Errorf("The returns should be closed with the publisher")
+	}
+}
+
+func TestKafkaPublisherBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("too-large", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetError("too-large", 0, sarama.ErrMessageSizeTooLarge),
+	})
+
+	options := publisherOptions{sink: sinkKafka, kafka: kafkaOptions{brokers: []string{broker.Addr()}, topics: map[string]string{"q.large": "too-large"}}}
+	options.urls = []string{kafkaURL(options.kafka)}
+	publisher, err := newPublisher(options, 0, "")
+	if err != nil {
+		t.Fatalf("newPublisher() failed: %v", err)
+	}
+	defer publisher.Close()
+	if err := publisher.Publish("", "orders", true, false, amqp.Publishing{Body: []byte("hello")}); err != nil {
+		t.Errorf("Publish() failed: %v", err)
+	}
+	if err := publisher.Publish("", "q.large", true, false, amqp.Publishing{Body: []byte("hello")}); !isNacked(err) {
+		t.Errorf("A message refused by the broker should be nacked, got %v", err)
+	}
+	if name := options.targetName(0); name != broker.Addr() {
+		t.Errorf("The summary reports %s, expected the brokers %s", name, broker.Addr())
+	}
+}
+
+func TestCheckSink(t *testing.T) {
+	if err := checkSink(sinkKafka, kafkaOptions{}); err == nil {
+		t.Errorf("--sink kafka without brokers should be rejected")
+	}
+	if err := checkSink(sinkKafka, kafkaOptions{brokers: []string{"localhost:9092"}}); err != nil {
+		t.Errorf("checkSink() failed: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/coveooss/gotemplate/v3/collections"
+)
+
+// lostEntry is an entry of the lost messages config used by find-lost
+type lostEntry struct {
+	name     string // Name of the queue
+	messages int    // Number of messages lost by the queue
+	exchange string // Optional exchange the queue is bound to
+}
+
+// lostEntryFields are the fields allowed in an entry of the lost messages config
+var lostEntryFields = map[string]bool{"name": true, "messages": true, "exchange": true}
+
+// readLostMessages loads the lost messages config and validates it before any processing
+// The config must be a list of {name, messages[, exchange]} maps with unique names. Every invalid entry is
+// reported in the returned error, one per line.
+func readLostMessages(fileName string) ([]lostEntry, error) {
+	var data interface{}
+	if err := collections.ConvertData(string(must(ioutil.ReadFile(fileName)).([]byte)), &data); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %v", fileName, err)
+	}
+	list, err := collections.TryAsList(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s must contain a list of {name, messages} entries", fileName)
+	}
+
+	var (
+		entries   []lostEntry
+		problems  []string
+		names     = make(map[string]int)
+		exchanges = make(map[string]int)
+	)
+	for i, item := range list.AsArray() {
+		entry, err := parseLostEntry(item)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d: %v", i+1, err))
+			continue
+		}
+		if first, ok := names[entry.name]; ok {
+			problems = append(problems, fmt.Sprintf("entry %d: name '%s' is already used by entry %d", i+1, entry.name, first))
+			continue
+		}
+		if first, ok := exchanges[entry.name]; ok {
+			problems = append(problems, fmt.Sprintf("entry %d: name '%s' is already used as exchange by entry %d", i+1, entry.name, first))
+			continue
+		}
+		if first, ok := names[entry.exchange]; ok {
+			problems = append(problems, fmt.Sprintf("entry %d: exchange '%s' is already used as name by entry %d", i+1, entry.exchange, first))
+			continue
+		}
+		names[entry.name] = i + 1
+		if _, ok := exchanges[entry.exchange]; entry.exchange != "" && !ok {
+			exchanges[entry.exchange] = i + 1
+		}
+		entries = append(entries, entry)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid lost messages config %s:\n  %s", fileName, strings.Join(problems, "\n  "))
+	}
+	return entries, nil
+}
+
+// parseLostEntry validates an entry of the lost messages config against its schema
+// The number of messages may be expressed as an integer, a float without decimals or a numeric string.
+func parseLostEntry(item interface{}) (result lostEntry, err error) {
+	entry, err := collections.TryAsDictionary(item)
+	if err != nil {
+		return result, fmt.Errorf("must be a map with fields 'name' and 'messages', got %v", item)
+	}
+	var unknown []string
+	for _, key := range entry.KeysAsString() {
+		if !lostEntryFields[key.Str()] {
+			unknown = append(unknown, "'"+key.Str()+"'")
+		}
+	}
+	if len(unknown) > 0 {
+		return result, fmt.Errorf("unknown field %s", strings.Join(unknown, ", "))
+	}
+
+	if !entry.Has("name") {
+		return result, fmt.Errorf("field 'name' is required")
+	}
+	if result.name, _ = entry.Get("name").(string); result.name == "" {
+		return result, fmt.Errorf("field 'name' must be a non empty string, got %v", entry.Get("name"))
+	}
+
+	if !entry.Has("messages") {
+		return result, fmt.Errorf("field 'messages' is required")
+	}
+	invalid := fmt.Errorf("field 'messages' must be a non-negative integer, got %v", entry.Get("messages"))
+	switch value := entry.Get("messages").(type) {
+	case int:
+		result.messages = value
+	case int64:
+		result.messages = int(value)
+	case float64:
+		if value != math.Trunc(value) {
+			return result, invalid
+		}
+		result.messages = int(value)
+	case string:
+		if result.messages, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+			return result, invalid
+		}
+	default:
+		return result, invalid
+	}
+	if result.messages < 0 {
+		return result, invalid
+	}
+
+	if entry.Has("exchange") {
+		if result.exchange, _ = entry.Get("exchange").(string); result.exchange == "" {
+			return result, fmt.Errorf("field 'exchange' must be a non empty string, got %v", entry.Get("exchange"))
+		}
+	}
+	return result, nil
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,6 +17,8 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/coveooss/gotemplate/v3/collections"
 	"github.com/coveooss/gotemplate/v3/hcl"
@@ -27,16 +29,16 @@ import (
 	"github.com/coveord/kingpin/v2"
 	"github.com/fatih/color"
 	"github.com/olekukonko/tablewriter"
-	"github.com/streadway/amqp"
 )
 
 // Version is initialized at build time through -ldflags "-X main.Version=<version number>"
 var version = "1.0.0"
 
 const (
-	rabbitUser     = "RABBIT_USER"
-	rabbitPassword = "RABBIT_PASSWORD"
-	rabbitHost     = "RABBIT_HOST"
+	rabbitUser       = "RABBIT_USER"
+	rabbitPassword   = "RABBIT_PASSWORD"
+	rabbitHost       = "RABBIT_HOST"
+	rabbitManagement = "RABBIT_MANAGEMENT_URL"
 )
 
 const description = `
@@ -55,6 +57,7 @@ var (
 
 func main() {
 	var exitCode int
+	var profiling *profiler
 
 	defer func() {
 		if rec := recover(); rec != nil {
@@ -62,6 +65,10 @@ func main() {
 			debug.PrintStack()
 			exitCode = -1
 		}
+		if runErrors.Report() && exitCode == 0 {
+			exitCode = 1
+		}
+		profiling.Stop()
 		os.Exit(exitCode)
 	}()
 
@@ -69,38 +76,158 @@ func main() {
 		app              = kingpin.New(os.Args[0], description).AutoShortcut()
 		getVersion       = app.Flag("version", "Get the current version of the replayer").Short('v').Bool()
 		colorModeIsSet   bool
-		colorMode        = app.Flag("color", "Force rendering of colors event if output is redirected.").IsSetByUser(&colorModeIsSet).Bool()
-		folder           = app.Flag("folder", "Folder where to find messages.").Short('f').ExistingDir()
-		rabbitURL        = app.Flag("rabbit-host", "The RabbitMQ Url. Env="+rabbitHost).Short('H').Envar(rabbitHost).String()
-		rabbitPrototocol = app.Flag("protocol", "The RabbitMQ protocol.").Default("amqp").String()
+		colorMode        = app.Flag("color", "Color mode: auto (only if output is a terminal), always or never (--color and --no-color are deprecated aliases of always and never).").IsSetByUser(&colorModeIsSet).Default("auto").Enum("auto", "always", "never", "true", "false")
+		folder           = app.Flag("folder", "Folder where to find messages (could be repeated).").Short('f').ExistingDirs()
+		sourceURL        = app.Flag("source", "Read the files from a remote storage instead of --folder (s3://bucket/prefix).").PlaceHolder("URL").NoAutoShortcut().String()
+		rabbitHosts      = app.Flag("rabbit-host", "The RabbitMQ host[:port], could be repeated to publish every message to several clusters. Env="+rabbitHost).Short('H').Envar(rabbitHost).Strings()
+		requireAll       = app.Flag("require-all", "With several --rabbit-host, count a message as failed unless it has been published to every cluster (by default, one cluster is enough). Unless --confirm is set, a message is published once written to the connection.").Bool()
+		rabbitPrototocol = app.Flag("protocol", "The RabbitMQ protocol (amqp, amqps, "+protocolAMQP10+" or "+protocolAMQPS10+" for an AMQP 1.0 endpoint such as Azure Service Bus, the messages are then sent to the address named by the queue, or by the exchange with the routing key as subject).").Default(protocolAMQP).Enum(protocolAMQP, protocolAMQPS, protocolAMQP10, protocolAMQPS10)
+		tlsCA            = app.Flag("tls-ca", "PEM file of the CA used to verify the certificate of the brokers with --protocol amqps or "+protocolAMQPS10+" (the system CAs by default).").PlaceHolder("FILE").NoAutoShortcut().ExistingFile()
+		tlsCert          = app.Flag("tls-cert", "PEM file of the client certificate presented to the brokers with --protocol amqps or "+protocolAMQPS10+" (requires --tls-key).").PlaceHolder("FILE").NoAutoShortcut().ExistingFile()
+		tlsKey           = app.Flag("tls-key", "PEM file of the private key of --tls-cert.").PlaceHolder("FILE").NoAutoShortcut().ExistingFile()
+		tlsSkipVerify    = app.Flag("tls-skip-verify", "Do not verify the certificate of the brokers with --protocol amqps or "+protocolAMQPS10+".").NoAutoShortcut().Bool()
 		rabbitPort       = app.Flag("port", "The RabbitMQ port.").Default("5672").NoAutoShortcut().Int()
 		user             = app.Flag("user", "User used to connect to RabbitMQ. Env="+rabbitUser).Short('u').Default("guest").Envar(rabbitUser).String()
 		password         = app.Flag("password", "Password used to connect to RabbitMQ. Env="+rabbitPassword).Default("guest").NoAutoShortcut().Envar(rabbitPassword).String()
+		sink             = app.Flag("sink", "Where the messages are replayed (RabbitMQ with amqp or Kafka topics named after the queues).").Default(sinkAMQP).NoAutoShortcut().Enum(sinkAMQP, sinkKafka)
+		kafkaBrokers     = app.Flag("kafka-brokers", "Kafka brokers (host:port) used with --sink kafka (could be repeated).").PlaceHolder("HOST:PORT").Strings()
+		kafkaTopics      = app.Flag("kafka-topic", "Topic used for the messages of a queue (or exchange) with --sink kafka, the name of the queue is used by default and the routing key of the messages published to an exchange is their key (could be repeated).").PlaceHolder("QUEUE=TOPIC").Strings()
 		declareQueue     = app.Flag("declare-queues", "Force queue creation if it does not exist").Bool()
+		onConflict       = app.Flag("on-declare-conflict", "With --declare-queues, handling of the queues that already exist with different properties: publish to the existing queue (skip) or count their messages as failed (fail).").Default(declareConflictSkip).Enum(declareConflictSkip, declareConflictFail)
+		maxPriority      = app.Flag("max-priority", "x-max-priority argument of the queues created with --declare-queues (original priorities are always republished).").PlaceHolder("N").Int()
+		preserveHeaders  = app.Flag("preserve-headers", "Republish the original headers of the messages found by full --replay (the exported files do not retain them), the headers added by the replayer (cmf, "+replayAttemptHeader+") take precedence. Implied by --preserve-properties and by --faithful-routing for the messages published to an exchange.").NoAutoShortcut().Bool()
+		preserveProps    = app.Flag("preserve-properties", "Republish the original properties of the messages found by full --replay (content-type, content-encoding, correlation-id, reply-to, type, app-id, timestamp and headers), the message id, priority and expiration are always republished. Use --no-preserve-properties to only republish the headers requested by --preserve-headers (implied by --faithful-routing for the messages published to an exchange).").Default("true").NoAutoShortcut().Bool()
+		faithfulRouting  = app.Flag("faithful-routing", "Publish the messages to their original exchange with their original routing key, headers and properties (with --declare-queues, missing exchanges are declared as topic exchanges).").Bool()
+		isExchange       = app.Flag("is-exchange", "Publish to the exchange named after the queue when the original destination cannot be detected (with the original routing key, or the name of the queue if it has not been found)").Bool()
+		queuePrefix      = app.Flag("queue-prefix", "Prefix added to the queue name when replaying messages.").String()
+		queueSuffix      = app.Flag("queue-suffix", "Suffix added to the queue name when replaying messages.").String()
+		verifyReplay     = app.Flag("verify-after-replay", "Compare the number of messages added to each queue with the number of published messages.").Bool()
+		dropExpired      = app.Flag("drop-expired", "Do not replay messages whose original expiration has already elapsed.").Bool()
+		replayLogFile    = app.Flag("replay-log", "Append a JSON line for each published message to the file.").PlaceHolder("PATH").String()
+		skipLogged       = app.Flag("skip-logged", "Skip messages already recorded in a replay log (matched by message-id or body hash).").PlaceHolder("PATH").ExistingFile()
+		bodyReplace      = app.Flag("body-replace", "Replace a value in the message bodies before replay (old=new, could be repeated).").PlaceHolder("OLD=NEW").Strings()
+		bodyReplaceRegex = app.Flag("body-replace-regex", "Replace a regular expression in the message bodies before replay (regexp=replacement, could be repeated).").PlaceHolder("REGEXP=NEW").Strings()
+		vhostMap         = app.Flag("vhost-map", "File mapping queue names (or regular expressions) to the vhost where their messages are replayed (default vhost otherwise).").PlaceHolder("PATH").ExistingFile()
+		persistence      = app.Flag("persistence-map", "File mapping queue names (or regular expressions) to persistent or transient delivery mode (default persistent).").PlaceHolder("PATH").ExistingFile()
+		paceByTimestamp  = app.Flag("pace-by-timestamp", "Wait between publishes to approximate the original spacing of the message timestamps (requires ordered replay, full uses a single publisher).").Bool()
+		timeScale        = app.Flag("time-scale", "Multiplier applied to the original spacing with --pace-by-timestamp (0.5 replays twice as fast).").Default("1").Float64()
+		maxTotalBytes    = app.Flag("max-total-bytes", "Stop publishing once the total size of the published bodies reaches N bytes.").PlaceHolder("N").Int64()
+		confirm          = app.Flag("confirm", "Put the channels in confirm mode and wait for the broker to confirm each message, a message is only counted as published once acked (the nacked messages are counted as failed and listed at the end of the run).").NoAutoShortcut().Bool()
+		mandatory        = app.Flag("mandatory", "Publish with the mandatory flag, unroutable messages are returned (use --no-mandatory to disable).").Default("true").Bool()
+		immediate        = app.Flag("immediate", "Publish with the immediate flag (not supported by RabbitMQ 3.0 and later).").NoAutoShortcut().Bool()
+		poolWarmup       = app.Flag("publisher-pool-warmup", "Connect all publishers (to every vhost of --vhost-map) before publishing the first message and report the setup time. With --declare-queues, the queues of the replay command are declared up front.").NoAutoShortcut().Bool()
+		summaryJSON      = app.Flag("summary-json", "Write the outcome of the replay by queue (published, failed, returned and bytes) with the totals and the run metadata as JSON (replay and full --replay).").PlaceHolder("PATH").NoAutoShortcut().String()
+		rate             = app.Flag("rate", "Maximum number of messages published per second by replay, full --replay and publish-http, shared by all the publishers (0 means unlimited).").NoAutoShortcut().Int()
+		maxRetries       = app.Flag("max-retries", "Number of times the connection is reestablished to retry a message whose publish (or connection or queue declaration) failed, the delay between the attempts doubles from 1s up to 30s (retried messages have an "+replayAttemptHeader+" header). The messages that still fail are counted as failed.").Default("3").Int()
+		deadLetterDir    = app.Flag("dead-letter-folder", "Folder where the messages that could not be published to any target are written (a file per queue in the format of find-lost, see --output-encoding), so they could be replayed later.").PlaceHolder("FOLDER").NoAutoShortcut().String()
+		methodMatch      = app.Flag("method-match", "Regular expression for matching the method of the messages to replay (the method is unknown for plain exports).").PlaceHolder("regexp").NoAutoShortcut().String()
+		methodExclude    = app.Flag("method-exclude", "Regular expression for the methods of the messages that must not be replayed (Delete...).").PlaceHolder("regexp").NoAutoShortcut().String()
+		fallbackToQueue  = app.Flag("fallback-to-queue", "Publish messages returned by an exchange directly to the queue with the same name").Bool()
 		match            = app.Flag("match", "Regular expression for matching queues").Short('m').PlaceHolder("regexp").String()
-		maxDepth         = app.Flag("max-depth", "Maximum depth to find.").Default("5").Int()
+		maxFiles         = app.Flag("max-files", "Only process the first N files found (sorted by name) to sample a large tree.").PlaceHolder("N").Int()
+		maxDepthIsSet    bool
+		maxDepth         = app.Flag("max-depth", "Maximum depth to find (0 or less means unlimited). Replay only reads the top level of --folder unless it is set.").IsSetByUser(&maxDepthIsSet).Default("5").Int()
 		outputFolder     = app.Flag("output-folder", "Where queue data should be exported").String()
-		threads          = app.Flag("threads", "Number of parallel threads running.").Short('t').Default(fmt.Sprint((runtime.NumCPU() + 1) / 2)).Int()
-		verbose          = app.Flag("verbose", "Indicate to add traces during processing").Short('V').Bool()
-		patterns         = app.Flag("pattern", "Pattern used to find persistent store or index files.").Short('p').Default("*.rdq", "*.idx").Strings()
+		timestampOutput  = app.Flag("timestamp-output", "Write the files of find-lost, split-messages and export-raw in a sub folder of --output-folder named after the run id (the start time as YYYYMMDD-HHMMSS unless --run-id is set).").NoAutoShortcut().Bool()
+		runIDFlag        = app.Flag("run-id", "Name of the sub folder of --output-folder where find-lost, split-messages and export-raw write their files (implies --timestamp-output).").NoAutoShortcut().String()
+		compressOutput   = app.Flag("compress-output", "Compression of the files written by find-lost and split-messages.").Default(compressNone).Enum(compressNone, compressZstd)
+		outputEncoding   = app.Flag("output-encoding", "Encoding of the message bodies written by find-lost, split-messages and dump.").Default(bodyBase64).Enum(bodyBase64, bodyHex, bodyRaw, bodyBinary)
+		base64Variant    = app.Flag("base64-variant", "Alphabet of the base64 bodies written by find-lost, split-messages and dump and read by replay and publish-http (url uses - and _, raw variants have no padding).").Default("std").NoAutoShortcut().Enum("std", "url", "raw-std", "raw-url")
+		inputEncoding    = app.Flag("input-encoding", "Encoding of the message bodies read by replay and publish-http (auto detects the encoding of each line).").Default(bodyBase64).NoAutoShortcut().Enum(bodyAuto, bodyBase64, bodyHex, bodyRaw, bodyBinary)
+		checksums        = app.Flag("checksum-manifest", "Write a "+checksumFile+" with the checksum of the exported files (see verify-output).").Bool()
+		threads          = app.Flag("threads", "Number of parallel threads running (number of files read ahead by find-lost).").Short('t').Default(fmt.Sprint((runtime.NumCPU() + 1) / 2)).Int()
+		printTarget      = app.Flag("print-target", "Print the broker where messages are published (password masked) before replaying, also printed with --verbose.").Bool()
+		cpuProfile       = app.Flag("cpuprofile", "Write a CPU profile to the file (parse workers are labelled with their thread).").PlaceHolder("PATH").NoAutoShortcut().String()
+		memProfile       = app.Flag("memprofile", "Write a memory profile to the file when the program exits.").PlaceHolder("PATH").NoAutoShortcut().String()
+		verbose          = app.Flag("verbose", "Indicate to add detailed traces for each file during processing").Short('V').Bool()
+		progressJSON     = app.Flag("progress-json", "Write a JSON progress event every second to the file (or fd:N for an open file descriptor).").PlaceHolder("PATH").String()
+		summaryOnly      = app.Flag("summary-only", "Only show a progress indicator and the final tables, without per file traces").Bool()
+		inspect          = app.Flag("inspect", "Show the body encoding of each message with the first N bytes of the decompressed payload.").PlaceHolder("N").NoAutoShortcut().Int()
+		queueMarkerFlag  = app.Flag("queue-marker", "Marker preceding the exchange (or queue) name of the messages.").Default(string(queueMarker)).NoAutoShortcut().String()
+		maxErrors        = app.Flag("max-parse-errors", "Abort the run once N files could not be read or parsed, which denotes a format or --pattern mismatch. Below the limit, the files that cannot be parsed are reported and skipped (by default, there is no limit and every such file is skipped).").PlaceHolder("N").NoAutoShortcut().Int32()
+		unackedOnly      = app.Flag("only-unacked", "Skip the messages acknowledged according to the queue indexes (segment *.idx files and "+indexJournalFile+" found in the folders). Messages not found in the indexes are kept.").NoAutoShortcut().Bool()
+		inspectCMFFlag   = app.Flag("inspect-cmf", "Decode the PushAPI header ({url:...,method:...,zip:...}) stored with the push messages and print its fields (dump, peek and explain).").NoAutoShortcut().Bool()
+		framingFlag      = app.Flag("framing-header", "Marker preceding the content of the messages, to be changed if the messages have been stored by another protocol.").Default(string(framingHeader)).NoAutoShortcut().String()
+		methodMarkerFlag = app.Flag("method-marker", "Marker preceding the method in the PushAPI message bodies.").Default(string(methodMarker)).NoAutoShortcut().String()
+		startOffsetFlag  = app.Flag("start-offset", "Position (in bytes) where the parsing of each file starts, to skip a header or a corrupted prefix.").PlaceHolder("BYTES").NoAutoShortcut().Int64()
+		maxBytesFlag     = app.Flag("max-bytes", "Maximum number of bytes parsed in each file from --start-offset (0 means up to the end of the file).").PlaceHolder("BYTES").Int64()
+		storeVersionFlag = app.Flag("store-version", "Layout of the message store files: auto detects the classic queue v2 store files (.qs, RabbitMQ 3.12+) by their header, 1 only uses the legacy layout and 2 parses every file as a v2 store file, even without header (with --start-offset or an explicit --pattern).").Default(storeVersionAuto).NoAutoShortcut().Enum(storeVersionAuto, storeVersion1, storeVersion2)
+		maxMessageFlag   = app.Flag("max-message-size", "Ignore the framing markers followed by a message larger than BYTES, which are found by coincidence in binary payloads (0 means no limit, a message larger than the remaining data is always ignored unless it is the last one).").PlaceHolder("BYTES").NoAutoShortcut().Int()
+		skipCorruptFlag  = app.Flag("skip-corrupt", "Skip the messages whose structure is invalid and resume with the next message of the file (by default, the rest of the file is abandoned), the skipped messages are reported by file by full.").NoAutoShortcut().Bool()
+		streaming        = app.Flag("streaming", "Parse the persistent store files message by message instead of loading them whole in memory (index files and the files of --source are still loaded whole, incompatible with --join-segments).").NoAutoShortcut().Bool()
+		strictEOFFlag    = app.Flag("strict-eof", "Report the bytes left unparsed at the end of each file (trailing zeros and terminators are tolerated).").NoAutoShortcut().Bool()
+		terminators      = app.Flag("terminator-bytes", "Hexadecimal bytes accepted after each message of a persistent store file.").Default("ff").Strings()
+		joinSegments     = app.Flag("join-segments", "Process the persistent store files in segment order to reconstruct messages spanning two segments (dump, export-raw and full only, export-raw and full use a single parser).").Bool()
+		failUnknown      = app.Flag("fail-on-unknown", "Stop processing a file when the queue of a message cannot be found instead of putting it in "+unknownBucket+".").Bool()
+		replayUnknown    = app.Flag("replay-unknown", "Also replay the "+unknownBucket+" files (and their chunks) to a queue of that name with replay and publish-http, the messages whose queue has not been found are skipped by default.").NoAutoShortcut().Bool()
+		patterns         = app.Flag("pattern", "Pattern used to find persistent store or index files (their .zst and .gz compressed variants are also found).").Short('p').Default("*.rdq", "*.idx", "*"+storeV2Ext).Strings()
+		excludePatterns  = app.Flag("pattern-exclude", "Pattern of the files that must not be processed even if they match --pattern (could be repeated).").PlaceHolder("PATTERN").Strings()
 
 		findLostCommand = app.Command("find-lost", "Finds lost messages given a list of queues and how many messages they have lost")
 		lostMessages    = findLostCommand.Flag("lost-messages", "Map of lost messages by queue").Required().ExistingFile()
 		start           = findLostCommand.Flag("starts-with", "File number to start with").Int()
+		overRecovery    = findLostCommand.Flag("over-recovery-factor", "Flag the queues where more than N times the lost messages have been found, this usually denotes a queue name detection or config error (0 means disabled).").PlaceHolder("N").Float64()
+		failOnOver      = findLostCommand.Flag("fail-on-over-recovery", "Exit with an error if a queue is flagged by --over-recovery-factor.").Bool()
+		reportEmpty     = findLostCommand.Flag("report-empty-queues", "Keep the queues where no message has been found in the summary (their empty output files are removed anyway), use --no-report-empty-queues to hide them.").Default("true").Bool()
+		capToTarget     = findLostCommand.Flag("cap-to-target", "Stop writing messages for a queue once the number of lost messages has been found (newest first).").Bool()
 
 		splitCommand = app.Command("split-messages", "Finds lost messages given a list of queues and how many messages they have lost")
+		splitBy      = splitCommand.Flag("split-by", "Group output files by queue, by source file type (sub folder per type) or by shard (sub folder per hash of the queue name).").Default("queue").Enum("queue", "type", "shard")
+		manifestOnly = splitCommand.Flag("manifest-only", "Only write a "+manifestFile+" with the number of messages and bytes by queue, without any message file.").Bool()
+		shards       = splitCommand.Flag("shards", "Number of sub folders used with --split-by shard.").Default("16").Int()
+		maxOpenFiles = splitCommand.Flag("max-open-files", "Maximum number of output files kept open, the least recently used are closed and reopened when needed (0 means no limit).").Default("1000").Int()
+		chunkSize    = splitCommand.Flag("chunk-size", "Start a new numbered file (queue.0001, queue.0002...) every N messages (0 means a single file per queue).").PlaceHolder("N").Int()
 
 		replayCommand = app.Command("replay", "Replay messages that have been extracted by find-lost command")
-
-		fullCommand = app.Command("full", "Parse all files recursively in the source folder to find messages")
-		replay      = fullCommand.Flag("replay", "Actually replay the messages to the target Rabbit cluster.").Short('r').Bool()
-		output      = fullCommand.Flag("output", "Specify the output type (Json, Yaml, Hcl)").Short('o').Enum("Hcl", "h", "hcl", "H", "HCL", "Json", "j", "json", "J", "JSON", "Yaml", "Yml", "y", "yml", "yaml", "Y", "YML", "YAML")
+		replayOrder   = replayCommand.Flag("replay-order", "Order of the messages: files (discovery order), queues (sorted by queue name) or interleave (one message per queue in turn, keeps a file open per queue).").Default(replayByFiles).Enum(replayByFiles, replayByQueues, replayInterleave)
+		onMismatch    = replayCommand.Flag("on-checksum-mismatch", "Handling of the input files that do not match the "+checksumFile+" of their --folder: refuse to replay anything (fail), skip the file (skip) or replay it anyway (warn).").Default(checksumFail).Enum(checksumFail, checksumSkip, checksumWarn)
+		resume        = replayCommand.Flag("resume-from-offset", "Record the offset of the last line of each file published or written to --dead-letter-folder in a "+progressExt+" file and resume from it on restart (the progress of a file stops at its first failed message).").Bool()
+
+		publishHTTPCommand = app.Command("publish-http", "Replay messages extracted by find-lost (or exported by dump) through the RabbitMQ management HTTP API")
+		managementURL      = publishHTTPCommand.Flag("management-url", "The RabbitMQ management API url. Env="+rabbitManagement).Default("http://localhost:15672").Envar(rabbitManagement).String()
+		vhost              = publishHTTPCommand.Flag("vhost", "The virtual host where messages are published.").Default("/").String()
+
+		dumpCommand = app.Command("dump", "Dump the messages found in the files with their metadata")
+		headersOnly = dumpCommand.Flag("headers-only", "Only dump the message metadata, bodies are never written.").Bool()
+		dumpFormat  = dumpCommand.Flag("format", "Output format (json lines, csv or binary length delimited records of the bodies, see --output-encoding).").Default("json").Enum("json", "csv", bodyBinary)
+
+		offsetReportCommand = app.Command("offset-report", "Report the segment files that contain the messages of each queue, with the files without any of its messages in between")
+		offsetFormat        = offsetReportCommand.Flag("format", "Output format (table or json).").Default("table").Enum("table", "json")
+
+		verifyOutputCommand = app.Command("verify-output", "Verify the files of the output folder against its "+checksumFile)
+
+		verifyFormatCommand = app.Command("verify-format", "Verify that the files of --folder are valid message exports (find-lost, split-messages or dump) without connecting to a broker")
+		checkBodies         = verifyFormatCommand.Flag("check-bodies", "Also verify that the decoded bodies are not empty and that compressed bodies can be decompressed.").NoAutoShortcut().Bool()
+
+		explainCommand = app.Command("explain", "Trace the parsing of a single message to diagnose format mismatches")
+		explainFile    = explainCommand.Flag("file", "File containing the message.").Required().ExistingFile()
+		explainPos     = explainCommand.Flag("position", "Position of the message in the file.").Required().NoAutoShortcut().Int()
+
+		exportRawCommand = app.Command("export-raw", "Write the body of each message untouched in its own file of --output-folder named <queue>-<fileno>-<position>"+rawExt)
+
+		peekCommand = app.Command("peek", "Print the metadata of the first messages of a file without scanning it entirely")
+		peekFile    = peekCommand.Flag("file", "File to inspect.").Required().ExistingFile()
+		peekCount   = peekCommand.Flag("count", "Number of messages to print.").Default("5").NoAutoShortcut().Int()
+		peekPreview = peekCommand.Flag("preview", "Print a hex/ascii dump of the first N bytes of each body (0 means no preview).").PlaceHolder("N").NoAutoShortcut().Int()
+
+		fullCommand   = app.Command("full", "Parse all files recursively in the source folder to find messages")
+		replay        = fullCommand.Flag("replay", "Actually replay the messages to the target Rabbit cluster.").Short('r').Bool()
+		contentType   = fullCommand.Flag("content-type-match", "Regular expression for matching the content-type of the messages to replay").PlaceHolder("regexp").String()
+		queueDepth    = fullCommand.Flag("parse-workers-queue-depth", "Number of parsed files buffered before being aggregated (default 2 x threads).").PlaceHolder("N").Int()
+		interactive   = fullCommand.Flag("interactive", "Prompt for the queues to replay once the files have been parsed (ignored if stdin is not a terminal).").Bool()
+		sortBy        = fullCommand.Flag("sort-by", "Sort the rows of the statistic tables (insertion order by default).").Enum("name", "count", "messages", "size")
+		memLimit      = fullCommand.Flag("mem-limit", "Pause the parsing of new files while the heap exceeds N MB (0 means no limit).").PlaceHolder("MB").Int()
+		watch         = fullCommand.Flag("watch", "Keep running after the files have been processed and process the new (or modified) files appearing in --folder until interrupted.").Bool()
+		watchInterval = fullCommand.Flag("watch-interval", "Delay between the scans of --folder with --watch, new files are processed once unchanged for one interval.").Default("5s").Duration()
+		sortDesc      = fullCommand.Flag("sort-desc", "Sort the rows of the statistic tables in descending order.").Bool()
+		output        = fullCommand.Flag("output", "Specify the output type (Json, Yaml, Hcl)").Short('o').Enum("Hcl", "h", "hcl", "H", "HCL", "Json", "j", "json", "J", "JSON", "Yaml", "Yml", "y", "yml", "yaml", "Y", "YML", "YAML")
 	)
 
 	app.UsageWriter(os.Stdout)
 	kingpin.CommandLine = app
 	kingpin.CommandLine.HelpFlag.Short('h')
-	command := kingpin.Parse()
+	args, deprecatedColor := colorArgs(os.Args[1:])
+	command := kingpin.MustParse(app.Parse(args))
 
 	if *getVersion {
 		println(version)
@@ -108,7 +235,22 @@ func main() {
 	}
 
 	if colorModeIsSet {
-		color.NoColor = *colorMode
+		switch *colorMode {
+		case "true", "false":
+			errPrintln(color.YellowString("--color=%s is deprecated, use --color=always or --color=never", *colorMode))
+			color.NoColor = *colorMode == "false"
+		case "always":
+			color.NoColor = false
+		case "never":
+			color.NoColor = true
+		}
+		if deprecatedColor != "" {
+			errPrintln(color.YellowString("%s is deprecated, use --color=always or --color=never", deprecatedColor))
+		}
+	}
+
+	if *shards <= 0 {
+		*shards = 1
 	}
 
 	if *threads == 0 {
@@ -120,20 +262,277 @@ func main() {
 		re = regexp.MustCompile(*match)
 	}
 
+	var err error
+	if *cpuProfile != "" || *memProfile != "" {
+		if profiling, err = startProfiling(*cpuProfile, *memProfile); err != nil {
+			errPrintln(color.RedString("Unable to start profiling: %v", err))
+			os.Exit(1)
+		}
+	}
+
+	if source, err = newSource(*sourceURL, *folder); err != nil {
+		errPrintln(color.RedString(err.Error()))
+		os.Exit(1)
+	}
+
+	failOnUnknown = *failUnknown
+	strictEOF = *strictEOFFlag
+	if *startOffsetFlag < 0 || *maxBytesFlag < 0 {
+		errPrintln(color.RedString("--start-offset and --max-bytes must not be negative"))
+		os.Exit(1)
+	}
+	startOffset, maxBytes = *startOffsetFlag, *maxBytesFlag
+	if *streaming && *joinSegments {
+		errPrintln(color.RedString("--streaming cannot be used with --join-segments, the messages spanning two segments are reconstructed from the whole files"))
+		os.Exit(1)
+	}
+	streamFiles = *streaming
+	storeVersion = *storeVersionFlag
+	skipCorrupt = *skipCorruptFlag
+	if maxMessageSize = *maxMessageFlag; maxMessageSize < 0 {
+		errPrintln(color.RedString("--max-message-size must not be negative"))
+		os.Exit(1)
+	}
+	if *queueMarkerFlag == "" || *methodMarkerFlag == "" || *framingFlag == "" {
+		errPrintln(color.RedString("--queue-marker, --method-marker and --framing-header cannot be empty"))
+		os.Exit(1)
+	}
+	queueMarker, methodMarker, framingHeader = []byte(*queueMarkerFlag), []byte(*methodMarkerFlag), []byte(*framingFlag)
+	inspectCMF = *inspectCMFFlag
+	base64Body = base64Variants[*base64Variant]
+	if maxParseErrors = *maxErrors; maxParseErrors < 0 {
+		errPrintln(color.RedString("--max-parse-errors must not be negative"))
+		os.Exit(1)
+	}
+	outputCompression = *compressOutput
+	terminatorBytes = nil
+	for _, t := range *terminators {
+		for _, value := range strings.Split(t, ",") {
+			b, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(value), "0x"), 16, 8)
+			if err != nil {
+				errPrintln(color.RedString("Invalid terminator byte %q: %v", value, err))
+				os.Exit(1)
+			}
+			terminatorBytes = append(terminatorBytes, byte(b))
+		}
+	}
+
 	var patternList []string
 	for _, p := range *patterns {
-		patternList = append(patternList, strings.Split(p, ";")...)
+		for _, pattern := range strings.Split(p, ";") {
+			// Compressed files are also considered
+			patternList = append(patternList, pattern)
+			for _, ext := range compressionExts {
+				patternList = append(patternList, pattern+ext)
+			}
+		}
+	}
+	// findRabbitFiles returns the files to process according to the patterns
+	findRabbitFiles := func() []string {
+		files := must(source.Find(*maxDepth, patternList...)).([]string)
+		if len(*excludePatterns) > 0 {
+			var excluded int
+			if files, excluded = excludeFiles(files, *excludePatterns...); *verbose {
+				errPrintf(color.GreenString("%d file(s) excluded by --pattern-exclude\n"), excluded)
+			}
+		}
+		return files
+	}
+
+	if *unackedOnly {
+		indexFiles := must(source.Find(*maxDepth, "*.idx", "*.idx"+zstdExt, "*.idx"+gzipExt, indexJournalFile)).([]string)
+		if onlyUnacked, err = loadAckIndex(indexFiles); err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+		errPrintln(color.GreenString("Queue indexes: %s", onlyUnacked.Describe()))
+		defer onlyUnacked.Report()
+	}
+
+	scheme := protocolScheme(*rabbitPrototocol)
+	pubOptions := publisherOptions{
+		requireAll:      *requireAll,
+		confirm:         *confirm,
+		limiter:         newRateLimiter(*rate),
+		protocol:        *rabbitPrototocol,
+		declareQueues:   *declareQueue,
+		onConflict:      *onConflict,
+		isExchange:      *isExchange,
+		fallback:        *fallbackToQueue,
+		mandatory:       *mandatory,
+		immediate:       *immediate,
+		prefix:          *queuePrefix,
+		suffix:          *queueSuffix,
+		dropExpired:     *dropExpired,
+		retries:         *maxRetries,
+		maxPriority:     *maxPriority,
+		faithful:        *faithfulRouting,
+		preserveHeaders: *preserveHeaders,
+		preserveProps:   *preserveProps,
+		sink:            *sink,
+		kafka:           kafkaOptions{brokers: *kafkaBrokers},
+	}
+	if len(*rabbitHosts) == 0 {
+		*rabbitHosts = []string{""}
+	}
+	for _, host := range *rabbitHosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			// --port applies to the hosts that do not specify their own
+			host = fmt.Sprintf("%s:%d", host, *rabbitPort)
+		}
+		pubOptions.urls = append(pubOptions.urls, fmt.Sprintf("%s://%s:%s@%s", scheme, *user, *password, host))
+	}
+	for i, definitions := range [][]string{*bodyReplace, *bodyReplaceRegex} {
+		transforms, err := parseBodyTransforms(definitions, i == 1)
+		if err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+		pubOptions.transforms = append(pubOptions.transforms, transforms...)
+	}
+	if *paceByTimestamp {
+		pubOptions.timeScale = *timeScale
+	}
+	if *methodMatch != "" {
+		pubOptions.methodMatch = regexp.MustCompile(*methodMatch)
+	}
+	if *methodExclude != "" {
+		pubOptions.methodExclude = regexp.MustCompile(*methodExclude)
+	}
+	if *maxTotalBytes > 0 {
+		pubOptions.budget = &byteBudget{max: *maxTotalBytes}
+	}
+	if *vhostMap != "" {
+		if pubOptions.vhosts, err = readQueueMap(*vhostMap); err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+		if *verifyReplay {
+			errPrintln(color.YellowString("--verify-after-replay only checks the queues of the default vhost"))
+		}
+	}
+	if scheme == protocolAMQPS {
+		if tlsConfig, err = newTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsSkipVerify); err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+	} else if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" || *tlsSkipVerify {
+		errPrintln(color.YellowString("The --tls flags are ignored with --protocol %s", *rabbitPrototocol))
+	}
+	if *persistence != "" {
+		if pubOptions.persistence, err = readPersistenceMap(*persistence); err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+	}
+	if command == replayCommand.FullCommand() || command == fullCommand.FullCommand() && *replay {
+		if pubOptions.sink == sinkKafka {
+			if *declareQueue || *confirm || *verifyReplay {
+				errPrintln(color.YellowString("--declare-queues, --confirm and --verify-after-replay are ignored with --sink %s, the messages always wait for the acknowledgement of the brokers", sinkKafka))
+				*verifyReplay = false
+			}
+			if len(*rabbitHosts) > 1 || (*rabbitHosts)[0] != "" {
+				errPrintln(color.YellowString("--rabbit-host is ignored with --sink %s, the messages are published to --kafka-brokers", sinkKafka))
+			}
+			pubOptions.urls = []string{kafkaURL(pubOptions.kafka)}
+		} else if isAMQP10(pubOptions.protocol) {
+			if *declareQueue || *confirm {
+				errPrintln(color.YellowString("--declare-queues and --confirm are ignored with --protocol %s, the messages always wait for their settlement", pubOptions.protocol))
+			}
+			if *verifyReplay {
+				errPrintln(color.YellowString("--verify-after-replay requires AMQP 0-9-1, it is disabled with --protocol %s", pubOptions.protocol))
+				*verifyReplay = false
+			}
+		}
+		if pubOptions.kafka.topics, err = parseTopicMap(*kafkaTopics); err == nil {
+			err = checkSink(pubOptions.sink, pubOptions.kafka)
+		}
+		if err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+		if (*printTarget || *verbose) && pubOptions.sink == sinkKafka {
+			errPrintln(fmt.Sprintf("Publishing to the Kafka brokers %s", strings.Join(pubOptions.kafka.brokers, ", ")))
+		} else if *printTarget || *verbose {
+			for target := range pubOptions.urls {
+				errPrintln(pubOptions.describeTarget(target))
+			}
+		}
+	}
+	if *replayLogFile != "" && (command == replayCommand.FullCommand() || command == publishHTTPCommand.FullCommand() || command == fullCommand.FullCommand() && *replay) {
+		pubOptions.log = newReplayLog(*replayLogFile)
+		defer pubOptions.log.Close()
+	}
+	if *verifyReplay && (command == replayCommand.FullCommand() || command == fullCommand.FullCommand() && *replay) {
+		if len(pubOptions.urls) > 1 {
+			errPrintln(color.YellowString("--verify-after-replay only checks the queues of the first --rabbit-host"))
+		}
+		if verifier, err := newQueueVerifier(pubOptions.urls[0]); err == nil {
+			pubOptions.verifier = verifier
+			defer verifier.Close()
+		} else {
+			// Only the verification is abandoned, the messages are replayed anyway
+			errPrintln(color.YellowString("Unable to connect to %s to verify the replay (%v), the queues are not verified", pubOptions.targetName(0), err))
+			runErrors.Add(errorVerify, err, "", "", -1)
+		}
+	}
+	if *deadLetterDir != "" && (command == replayCommand.FullCommand() || command == publishHTTPCommand.FullCommand() || command == fullCommand.FullCommand() && *replay) {
+		pubOptions.deadLetters = newDeadLetters(*deadLetterDir, *outputEncoding)
+		defer func() {
+			if err := pubOptions.deadLetters.Close(); err != nil {
+				errPrintln(color.RedString("Unable to write %s: %v", *deadLetterDir, err))
+				exitCode = 1
+			}
+		}()
+	}
+	if *skipLogged != "" {
+		pubOptions.logged = readReplayLog(*skipLogged)
+	}
+
+	var progressOut io.WriteCloser
+	if *progressJSON != "" {
+		if progressOut, err = openProgressJSON(*progressJSON); err != nil {
+			errPrintln(color.RedString(err.Error()))
+			os.Exit(1)
+		}
+		defer progressOut.Close()
+	}
+	startProgress := func(total int) *progressIndicator {
+		progress := newProgressIndicator(total, *summaryOnly)
+		if progressOut != nil {
+			progress.EmitJSON(progressOut)
+		}
+		return progress
 	}
 
 	var files []string
-	if command == findLostCommand.FullCommand() || command == splitCommand.FullCommand() {
+	var outputSums *checksumManifest
+	if command == findLostCommand.FullCommand() || command == splitCommand.FullCommand() || command == exportRawCommand.FullCommand() || command == verifyOutputCommand.FullCommand() {
 		if *outputFolder == "" {
 			errPrintln("You need to specify an output folder")
 			os.Exit(1)
 		}
+	}
+	started := time.Now()
+	var runID string
+	if command == findLostCommand.FullCommand() || command == splitCommand.FullCommand() || command == exportRawCommand.FullCommand() {
+		if runID = *runIDFlag; runID == "" && *timestampOutput {
+			runID = time.Now().Format("20060102-150405")
+		}
+		if runID != "" {
+			if strings.ContainsAny(runID, `/\`) || runID == "." || runID == ".." {
+				errPrintln(color.RedString("Invalid run id %q, it must be a folder name", runID))
+				os.Exit(1)
+			}
+			*outputFolder = path.Join(*outputFolder, runID)
+			errPrintln(color.GreenString("Writing run %s to %s", runID, *outputFolder))
+		}
+		if *checksums {
+			outputSums = newChecksumManifest(*outputFolder)
+		}
 		// Get files in reverse order
 		errPrintln(color.GreenString("Finding files"))
-		files = utils.MustFindFilesMaxDepth(*folder, *maxDepth, false, patternList...)
+		files = findRabbitFiles()
 		errPrintf(color.GreenString("Found %v files. Sorting files\n"), len(files))
 
 		// Create output folder
@@ -167,37 +566,40 @@ func main() {
 		}
 
 		// Parse configuration file and create output files (faster to create them all here and delete unneeded ones than check if they are created at runtime)
-		var lostMessagesData []interface{}
+		lostEntries, err := readLostMessages(*lostMessages)
+		if err != nil {
+			errPrintln(color.RedString("%v", err))
+			os.Exit(1)
+		}
 
 		type FindData struct {
 			toFind      int
 			found       int
 			pushAPI     int
 			done        bool
+			capped      int
 			exchange    string
 			filePath    string
-			fileHandler *os.File
+			fileHandler *outputFile
 			queues      []string
 		}
 
 		lostMessagesMap := make(map[string]*FindData)
-		must(collections.ConvertData(string(must(ioutil.ReadFile(*lostMessages)).([]byte)), &lostMessagesData))
-		for _, item := range lostMessagesData {
-			itemAsMap := item.(json.Dictionary)
-			queueName := itemAsMap["name"].(string)
-			filePath := path.Join(*outputFolder, queueName)
+		for _, entry := range lostEntries {
+			queueName, toFind, exchange := entry.name, entry.messages, entry.exchange
+			fileHandler := createOutput(path.Join(*outputFolder, queueName))
 			lostMessagesMap[queueName] = &FindData{
-				toFind:      itemAsMap["messages"].(int),
-				filePath:    filePath,
-				fileHandler: must(os.Create(filePath)).(*os.File),
+				toFind:      toFind,
+				filePath:    fileHandler.Name(),
+				fileHandler: fileHandler,
 			}
 
-			if exchange, _ := itemAsMap["exchange"].(string); exchange != "" {
+			if exchange != "" {
 				if exchangeRecord := lostMessagesMap[exchange]; exchangeRecord == nil {
-					filePath := path.Join(*outputFolder, exchange)
+					fileHandler := createOutput(path.Join(*outputFolder, exchange))
 					lostMessagesMap[exchange] = &FindData{
-						filePath:    filePath,
-						fileHandler: must(os.Create(filePath)).(*os.File),
+						filePath:    fileHandler.Name(),
+						fileHandler: fileHandler,
 						queues:      []string{queueName},
 					}
 				} else {
@@ -206,7 +608,26 @@ func main() {
 			}
 		}
 
+		// reachedTarget determines if all lost messages of a queue (or of all queues bound to an exchange) have been found
+		reachedTarget := func(queueInfo *FindData) bool {
+			if len(queueInfo.queues) == 0 {
+				return queueInfo.toFind > 0 && queueInfo.found >= queueInfo.toFind
+			}
+			for _, queue := range queueInfo.queues {
+				if queueInfo := lostMessagesMap[queue]; queueInfo.found < queueInfo.toFind {
+					return false
+				}
+			}
+			return true
+		}
+
+		written := 0
+		var unknownFile *outputFile
+		var unknownCount int
 		filesHandled := 0
+		progress := startProgress(len(files))
+		// The next files are read while the current one is searched, they are still processed in reverse order
+		reader := newReadAhead(files, *threads)
 		// Find messages and write them to the file
 		for _, file := range files {
 			stillNeedToProcess := false
@@ -221,26 +642,62 @@ func main() {
 			if !stillNeedToProcess {
 				break
 			}
-			errPrintln(color.GreenString("Handling file: " + file))
+			if !*summaryOnly {
+				errPrintln(color.GreenString("Handling file: " + file))
+			}
 			filesHandled++
 
-			data, err := ReadRabbitFile(file, nil)
+			data, err := reader.Next()
 			if err != nil {
-				errPrintln(color.RedString(err.Error()))
+				progress.Add(0, 0)
+				parseFailed(file, err)
 				continue
 			}
 			data.ProcessMessages(func(msg *RabbitMessage) {
+				if msg.Queue == unknownQueue {
+					// Messages without destination are kept for manual triage
+					if unknownFile == nil {
+						unknownFile = createOutput(path.Join(*outputFolder, unknownBucket))
+					}
+					if _, err := unknownFile.WriteString(exportRecord(*outputEncoding, msg.Data)); err != nil {
+						abortWrite(unknownFile.Name(), err, written)
+					}
+					written++
+					unknownCount++
+					return
+				}
 				if queueInfo, ok := lostMessagesMap[msg.Queue]; ok && !queueInfo.done {
+					if *capToTarget && reachedTarget(queueInfo) {
+						queueInfo.capped++
+						return
+					}
 					if msg.IsPush() {
 						queueInfo.pushAPI++
 					}
-					queueInfo.fileHandler.WriteString(fmt.Sprintln(base64.StdEncoding.EncodeToString(msg.Data)))
+					if _, err := queueInfo.fileHandler.WriteString(exportRecord(*outputEncoding, msg.Data)); err != nil {
+						abortWrite(queueInfo.filePath, err, written)
+					}
+					written++
 					queueInfo.found++
 					for _, queue := range queueInfo.queues {
 						lostMessagesMap[queue].found++
 					}
 				}
 			})
+			progress.Add(data.Count(), data.Size())
+			if *verbose {
+				errPrintf("%s %d messages %.0f bytes\n", data.Name(), data.Count(), data.Size())
+			}
+		}
+		reader.Stop()
+		progress.Done()
+		progress.Close()
+		if unknownFile != nil {
+			if err := unknownFile.Close(); err != nil {
+				abortWrite(unknownFile.Name(), err, written)
+			}
+			outputSums.Add(unknownFile.Name())
+			errPrintln(color.YellowString("%d messages without queue written to %s for manual triage", unknownCount, unknownFile.Name()))
 		}
 		errPrintln(color.GreenString("Completed!"))
 
@@ -250,37 +707,83 @@ func main() {
 		}
 		sort.Strings(keys)
 
-		table := getTable("Queue name", "To find", "Found", "PushAPI", "Crawlers", "Missing/Over")
+		table := getTable("Queue name", "To find", "Found", "PushAPI", "Crawlers", "Missing/Over", "Status")
 
 		// Output result and delete unneeded output files (empty)
-		var toFind, found, pushAPI int
+		var toFind, found, pushAPI, suspicious int
+		var empty []string
 		for _, queueName := range keys {
 			queueInfo := lostMessagesMap[queueName]
-			must(queueInfo.fileHandler.Close())
-			data := collections.NewList(queueName, queueInfo.toFind, queueInfo.found, queueInfo.pushAPI, queueInfo.found-queueInfo.pushAPI, queueInfo.found-queueInfo.toFind)
+			if err := queueInfo.fileHandler.Close(); err != nil {
+				abortWrite(queueInfo.filePath, err, written)
+			}
+			outputSums.Add(queueInfo.filePath)
+
+			var status string
+			switch {
+			case len(queueInfo.queues) > 0:
+				status = "Exchange"
+			case *overRecovery > 0 && float64(queueInfo.found) > float64(queueInfo.toFind)**overRecovery:
+				status = "Suspicious"
+				suspicious++
+				errPrintln(color.RedString("%s has %d messages recovered but only %d were lost (more than %g times), the queue names may be wrongly detected, double-check before replaying", queueName, queueInfo.found, queueInfo.toFind, *overRecovery))
+			case queueInfo.capped > 0:
+				status = "Capped"
+				errPrintln(color.YellowString("%s capped at %d messages, %d additional messages were not written", queueName, queueInfo.toFind, queueInfo.capped))
+			case queueInfo.found > queueInfo.toFind:
+				status = "Over"
+				errPrintln(color.YellowString("%s has %d messages recovered but only %d were lost, consumers may already have the extra messages (see --cap-to-target)", queueName, queueInfo.found, queueInfo.toFind))
+			case queueInfo.found == 0 && queueInfo.toFind > 0:
+				status = "Empty"
+				empty = append(empty, queueName)
+			case queueInfo.found < queueInfo.toFind:
+				status = "Missing"
+			default:
+				status = "Complete"
+			}
+			data := collections.NewList(queueName, queueInfo.toFind, queueInfo.found, queueInfo.pushAPI, queueInfo.found-queueInfo.pushAPI, queueInfo.found-queueInfo.toFind, status)
 
 			toFind += queueInfo.toFind
 			found += queueInfo.found
 			pushAPI += queueInfo.pushAPI
-			table.Append(data.Strings())
+			if *reportEmpty || queueInfo.found > 0 {
+				table.Append(data.Strings())
+			}
 			if queueInfo.found == 0 {
 				must(os.Remove(queueInfo.filePath))
+				outputSums.Remove(queueInfo.filePath)
 			}
 		}
-		data := collections.NewList("", toFind, found, pushAPI, found-pushAPI, found-toFind)
+		outputSums.Write()
+		data := collections.NewList("", toFind, found, pushAPI, found-pushAPI, found-toFind, "")
 		table.SetFooter(data.Strings())
 		table.Render()
+		if runID != "" {
+			fmt.Printf("Run %s written to %s\n", runID, *outputFolder)
+		}
 		fmt.Println()
+		if len(empty) > 0 {
+			errPrintln(color.RedString("No message found for %d queue(s)%s: %s", len(empty), iif(*reportEmpty, "", " (hidden by --no-report-empty-queues)"), strings.Join(empty, ", ")))
+		}
+		if suspicious > 0 {
+			errPrintln(color.RedString("%d queue(s) flagged by --over-recovery-factor, their messages may belong to other queues", suspicious))
+			if *failOnOver {
+				exitCode = 1
+			}
+		}
 
 	case splitCommand.FullCommand():
 		type WriteData struct {
 			file  string
 			value string
+			size  int
 		}
 
+		files = limitFiles(files, *maxFiles)
 		numThreads := int(math.Min(float64(len(files)), float64(*threads)))
 		errPrintln(color.GreenString("Reading with %v threads!\n", numThreads))
 
+		progress := startProgress(len(files))
 		filesToHandle := make(chan string, numThreads)
 		toWrite := make(chan WriteData)
 		doneReading := make(chan bool, numThreads)
@@ -293,13 +796,28 @@ func main() {
 					file, more := <-filesToHandle
 					if more {
 						atomic.AddInt32(&count, 1)
-						errPrintln(color.GreenString(" - Reading file " + file))
-						data := must(ReadRabbitFile(file, nil)).(RabbitFile)
+						if !*summaryOnly {
+							errPrintln(color.GreenString(" - Reading file " + file))
+						}
+						data, err := loadRabbitFile(file, nil)
+						if err != nil {
+							progress.Add(0, 0)
+							parseFailed(file, err)
+							continue
+						}
 						data.ProcessMessages(func(msg *RabbitMessage) {
 							if re == nil || re.MatchString(msg.Queue) {
-								toWrite <- WriteData{file: msg.Queue, value: fmt.Sprintln(base64.StdEncoding.EncodeToString(msg.Data))}
+								writeData := WriteData{file: splitPath(*splitBy, *shards, data.Type(), msg.Queue), size: len(msg.Data)}
+								if !*manifestOnly {
+									writeData.value = exportRecord(*outputEncoding, msg.Data)
+								}
+								toWrite <- writeData
 							}
 						})
+						progress.Add(data.Count(), data.Size())
+						if *verbose {
+							errPrintf("%s %d messages %.0f bytes\n", data.Name(), data.Count(), data.Size())
+						}
 					} else {
 						doneReading <- true
 						return
@@ -308,19 +826,49 @@ func main() {
 			}()
 		}
 
-		fileHandlers := make(map[string]*os.File)
+		outputs := newOutputCache(*maxOpenFiles)
+		messageCounts := make(map[string]int)
+		inventory := newManifest()
+		written := 0
 		go func() {
 			for {
 				writeData, more := <-toWrite
-				if more {
+				if more && *manifestOnly {
+					inventory.Add(writeData.file, writeData.size)
+				} else if more {
 					path := path.Join(*outputFolder, writeData.file)
-					fileHandle := fileHandlers[path]
-					if fileHandle == nil {
-						fileHandle = must(os.Create(path)).(*os.File)
-						fileHandlers[path] = fileHandle
+					if messageCounts[path] == 0 {
+						if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+							abortWrite(path, err, written)
+						}
 					}
-					fileHandle.WriteString(writeData.value)
+					fileName := path
+					if *chunkSize > 0 {
+						chunk := messageCounts[path] / *chunkSize
+						if chunk > 0 && messageCounts[path]%*chunkSize == 0 {
+							// The previous chunk is full
+							if err := outputs.Release(chunkFileName(path, chunk)); err != nil {
+								abortWrite(chunkFileName(path, chunk), err, written)
+							}
+						}
+						fileName = chunkFileName(path, chunk+1)
+					}
+					fileHandle, err := outputs.Get(fileName)
+					if err == nil {
+						_, err = fileHandle.WriteString(writeData.value)
+					}
+					if err != nil {
+						abortWrite(fileName, err, written)
+					}
+					messageCounts[path]++
+					written++
 				} else {
+					if err := outputs.Close(); err != nil {
+						abortWrite(*outputFolder, err, written)
+					}
+					for _, name := range outputs.Names() {
+						outputSums.Add(name)
+					}
 					doneWriting <- true
 					return
 				}
@@ -335,88 +883,313 @@ func main() {
 		for i := 0; i < numThreads; i++ {
 			<-doneReading
 		}
+		progress.Done()
+		progress.Close()
 		errPrintln(color.GreenString("Read %v files!\n", atomic.LoadInt32(&count)))
 		close(toWrite)
 
 		<-doneWriting
-		errPrintln(color.GreenString("Done writing!"))
+		if *manifestOnly {
+			inventory.Files, inventory.RunID = len(files), runID
+			errPrintln(color.GreenString("Manifest written to %s", inventory.Write(*outputFolder)))
+		} else {
+			errPrintln(color.GreenString("Done writing%s!", iif(runID == "", "", " run "+runID+" to "+*outputFolder)))
+			outputSums.Write()
+		}
 
 	case replayCommand.FullCommand():
-		url := fmt.Sprintf("%s://%s:%s@%s:%d", *rabbitPrototocol, *user, *password, *rabbitURL, *rabbitPort)
 		publish := make(chan *RabbitMessage)
 		completed := make(chan publisherStatus)
-		go messageHandler(0, url, publish, completed, *declareQueue)
-		files := utils.MustFindFilesMaxDepth(*folder, 1, false, "*")
-		for _, fileName := range files {
-			fmt.Println("Processing file", fileName)
-			file := must(os.Open(fileName)).(*os.File)
-			defer file.Close()
-
-			reader := bufio.NewReader(file)
-			for {
-				line, err := reader.ReadString('\n')
-				if err == io.EOF {
-					break
-				}
-				publish <- &RabbitMessage{
-					Queue: filepath.Base(fileName),
-					Data:  must(base64.StdEncoding.DecodeString(line)).([]byte),
+		// The queue is named after the file whatever its depth, so split outputs by type or by shard could be replayed
+		files := regularFiles(removeProgressFiles(findFiles(*folder, iif(maxDepthIsSet, *maxDepth, 1).(int), "*")))
+		if !*replayUnknown {
+			files = removeUnknownBucket(files)
+		}
+		var checked bool
+		if files, checked = checkInputChecksums(*folder, files, *onMismatch); !checked {
+			errPrintln(color.RedString("Replay refused, the input files do not match their checksums (see --on-checksum-mismatch)"))
+			os.Exit(1)
+		}
+		if *poolWarmup {
+			seen := make(map[string]bool)
+			var queues []string
+			for _, file := range files {
+				if queue := (&replayFile{name: file}).Queue(); !seen[queue] {
+					seen[queue] = true
+					queues = append(queues, queue)
 				}
 			}
+			pubOptions.warmup = newPublisherWarmup(1, queues)
+		}
+		progress := &replayProgress{enabled: *resume}
+		pubOptions.outcome = progress.Done
+		go messageHandler(0, pubOptions, publish, completed)
+		if pubOptions.warmup != nil {
+			errPrintln(color.GreenString("Publisher connected (%d queue(s) declared) in %v", iif(*declareQueue, len(pubOptions.warmup.queues), 0), pubOptions.warmup.Wait().Round(time.Millisecond)))
 		}
+		readReplayFiles(files, *replayOrder, *inputEncoding, *resume, func(file *replayFile, line string) bool {
+			position := int(file.offset) - len(line)
+			data, err := decodeBody(*inputEncoding, line)
+			if err != nil {
+				errPrintln(color.RedString("Unable to decode the message at offset %d of %s, it is skipped: %v", position, file.name, err))
+				runErrors.Add(errorDecode, err, file.name, file.Queue(), position)
+				return true
+			}
+			msg := &RabbitMessage{
+				Queue:    file.Queue(),
+				Data:     data,
+				File:     file.name,
+				Position: position,
+			}
+			progress.Sent(msg, file)
+			publish <- msg
+			return !pubOptions.budget.Exhausted()
+		})
 		close(publish)
 		fmt.Println("Waiting for publisher to complete")
 		status := <-completed
-		table := getTable("Queue name", "Published")
-		var total int
-		for queue, published := range status.published {
-			table.Append(collections.NewList(queue, published).Strings())
-			total += published
+		// The publisher has reported the outcome of every message once it has completed
+		progress.Flush()
+		printPublishSummary(pubOptions, status)
+		if *summaryJSON != "" {
+			writeSummaryJSON(*summaryJSON, command, *folder, started, pubOptions, status)
+		}
+		if pubOptions.verifier != nil && !pubOptions.verifier.Verify(status) {
+			exitCode = 1
+		}
+
+	case publishHTTPCommand.FullCommand():
+		publisher := newHTTPPublisher(*managementURL, *user, *password, *vhost, *rate)
+		files := removeProgressFiles(findFiles(*folder, 1, "*"))
+		if !*replayUnknown {
+			files = removeUnknownBucket(files)
+		}
+		status := publishHTTP(pubOptions, publisher, *inputEncoding, files)
+		printPublishSummary(pubOptions, status)
+
+	case dumpCommand.FullCommand():
+		if (*dumpFormat == bodyBinary) != (*outputEncoding == bodyBinary) || *dumpFormat == bodyBinary && *headersOnly {
+			errPrintln(color.RedString("--format binary requires --output-encoding binary and cannot be used with --headers-only"))
+			os.Exit(1)
+		}
+		files := limitFiles(findRabbitFiles(), *maxFiles)
+		dumper := newMessageDumper(os.Stdout, *dumpFormat, !*headersOnly, *outputEncoding)
+		var pending *segmentCarry
+		if *joinSegments {
+			sortSegments(files)
+		}
+		for _, file := range files {
+			data, err := loadRabbitFile(file, re)
+			if err != nil {
+				parseFailed(file, err)
+				continue
+			}
+			if *joinSegments {
+				data.JoinSegment(pending)
+			}
+			data.ProcessMessages(func(msg *RabbitMessage) { dumper.Write(file, msg) })
+			pending = data.Pending()
+		}
+		pending.warnIncomplete()
+		dumper.Flush()
+
+	case offsetReportCommand.FullCommand():
+		files := limitFiles(findRabbitFiles(), *maxFiles)
+		report := newOffsetReport()
+		var pending *segmentCarry
+		if *joinSegments {
+			sortSegments(files)
+		}
+		for _, file := range files {
+			data, err := loadRabbitFile(file, re)
+			if err != nil {
+				parseFailed(file, err)
+				continue
+			}
+			if *joinSegments {
+				data.JoinSegment(pending)
+			}
+			data.ProcessMessages(nil)
+			pending = data.Pending()
+			report.Add(&data)
+		}
+		pending.warnIncomplete()
+		must(report.Print(*offsetFormat))
+
+	case verifyOutputCommand.FullCommand():
+		if !verifyChecksums(*outputFolder) {
+			exitCode = 1
+		}
+
+	case verifyFormatCommand.FullCommand():
+		if !verifyFormat(removeProgressFiles(findFiles(*folder, 1, "*")), *inputEncoding, *checkBodies) {
+			exitCode = 1
+		}
+
+	case explainCommand.FullCommand():
+		data, err := ReadRabbitFile(*explainFile, nil)
+		if err == nil {
+			err = data.blob.Explain(*explainPos)
+		}
+		if err != nil {
+			errPrintln(color.RedString(err.Error()))
+			exitCode = 1
+		}
+
+	case exportRawCommand.FullCommand():
+		files = limitFiles(files, *maxFiles)
+		progress := startProgress(len(files))
+		exportRawMessages(files, *outputFolder, *threads, re, *joinSegments, outputSums, progress)
+		progress.Done()
+		progress.Close()
+		outputSums.Write()
+
+	case peekCommand.FullCommand():
+		data, err := loadRabbitFile(*peekFile, nil)
+		if err == nil {
+			err = data.Peek(*peekCount, *peekPreview)
+		}
+		if err != nil {
+			errPrintln(color.RedString(err.Error()))
+			exitCode = 1
 		}
-		table.SetFooter(collections.NewList("", total).Strings())
-		table.Render()
-		fmt.Println()
 
 	case fullCommand.FullCommand():
-		files := utils.MustFindFilesMaxDepth(*folder, *maxDepth, false, patternList...)
-		files = collections.AsList(files).Unique().Strings()
+		files := findRabbitFiles()
+		totalFiles := len(files)
+		files = limitFiles(files, *maxFiles)
 		if *verbose {
 			errPrintf(color.GreenString("%d %s on %d thread(s)\n", len(files), "file(s) to process", *threads))
 		}
 
-		url := fmt.Sprintf("%s://%s:%s@%s:%d", *rabbitPrototocol, *user, *password, *rabbitURL, *rabbitPort)
+		if *watch && *sourceURL != "" {
+			errPrintln(color.RedString("--watch is only supported on local folders"))
+			os.Exit(1)
+		}
+		if *interactive && !isTerminal(os.Stdin) {
+			errPrintln(color.YellowString("Interactive mode disabled, stdin is not a terminal"))
+			*interactive = false
+		}
 
 		// Start multithreads processing
 		jobs := make(chan string, *threads)
-		results := make(chan RabbitFile, len(files))
+		if *queueDepth <= 0 {
+			*queueDepth = 2 * *threads
+		}
+		results := make(chan RabbitFile, *queueDepth)
 		completed := make(chan publisherStatus)
 		var publish chan *RabbitMessage
 		if *replay {
 			publish = make(chan *RabbitMessage, *threads*30)
 		}
+		publishers := *threads
+		if *paceByTimestamp {
+			// The original spacing can only be reproduced if messages are published in order
+			publishers = 1
+		}
+		if *replay && *poolWarmup {
+			// The queues are only known once the files have been parsed
+			pubOptions.warmup = newPublisherWarmup(publishers, nil)
+		}
+		progress := startProgress(len(files))
+		pubOptions.progress = progress
+		parsers := *threads
+		if *joinSegments {
+			// Segments must be parsed in order by a single parser to carry the truncated messages
+			sortSegments(files)
+			parsers = 1
+		}
 		for i := 0; i < *threads; i++ {
-			go fileHandler(i, jobs, results, re)
+			if i < parsers {
+				id := i
+				go withWorkerLabel("parser", id, func() { fileHandler(id, jobs, results, re, *joinSegments) })
+			}
 
-			if *replay {
-				go messageHandler(i, url, publish, completed, *declareQueue)
+			if *replay && i < publishers {
+				go messageHandler(i, pubOptions, publish, completed)
 			}
 		}
 
-		// Add the files to process
-		for _, file := range files {
-			jobs <- file
-		}
-		close(jobs)
+		// Add the files to process while results are consumed (results are aggregated by name, so order does not matter)
+		// The size of each batch of files is sent before its files so the results can be awaited
+		guard := newMemoryGuard(*memLimit)
+		batches := make(chan int)
+		var received int32
+		go func() {
+			var dispatched int32
+			dispatch := func(batch []string) {
+				batches <- len(batch)
+				for _, file := range batch {
+					current := dispatched
+					guard.Wait(func() bool { return atomic.LoadInt32(&received) < current })
+					jobs <- file
+					dispatched++
+				}
+			}
+			dispatch(files)
+			if *watch {
+				errPrintln(color.GreenString("Watching for new files every %v, press Ctrl-C to stop", *watchInterval))
+				find := func() []string {
+					watched, _ := excludeFiles(findFiles(*folder, *maxDepth, patternList...), *excludePatterns...)
+					return watched
+				}
+				newFileWatcher(find, *watchInterval, files).Watch(func(batch []string) {
+					if *joinSegments {
+						sortSegments(batch)
+					}
+					if *verbose {
+						errPrintf(color.GreenString("%d new file(s) to process\n", len(batch)))
+					}
+					progress.AddTotal(len(batch))
+					dispatch(batch)
+				})
+			}
+			close(batches)
+			close(jobs)
+		}()
 
 		// Wait for results
-		var queueStat, qtStat, fileStat, ftStat Statistics
-		for range files {
+		var queueStat, qtStat, fileStat, ftStat, skippedStat, corruptStat Statistics
+		var pending []*RabbitMessage
+		var emptyFiles int
+		var reContentType *regexp.Regexp
+		if *contentType != "" {
+			reContentType = regexp.MustCompile(*contentType)
+		}
+		if pubOptions.warmup != nil {
+			errPrintln(color.GreenString("%d publisher(s) connected in %v", publishers, pubOptions.warmup.Wait().Round(time.Millisecond)))
+		}
+		remaining := 0
+	aggregate:
+		for {
+			for remaining == 0 {
+				batch, more := <-batches
+				if !more {
+					break aggregate
+				}
+				remaining = batch
+			}
+			remaining--
 			file := <-results
+			atomic.AddInt32(&received, 1)
+			progress.Add(file.Count(), file.Size())
+			if file.Empty {
+				emptyFiles++
+			}
 			if *verbose {
-				errPrintf("%s %d messages %.0f bytes\n", file.Name(), file.Count(), file.Size())
+				errPrintf("%s %d messages %.0f bytes%s\n", file.Name(), file.Count(), file.Size(), iif(file.Empty, " (empty file)", ""))
+			}
+			if *inspect > 0 {
+				for _, msg := range file.Messages {
+					inspectMessage(msg, *inspect)
+				}
 			}
 
 			queueStat.Join(file.Queues)
+			if corrupted := file.Corrupted(); corrupted.Messages() > 0 {
+				corrupted.Name = file.Name()
+				corruptStat.AddStatistic(corrupted)
+			}
 			if file.Count() > 0 {
 				fileStat.AddStatistic(file.Stat)
 				ftStat.AddGroup(file.Type(), file.Stat)
@@ -424,13 +1197,29 @@ func main() {
 
 			if *replay {
 				for _, msg := range file.Messages {
+					if reContentType != nil && !reContentType.MatchString(msg.ContentType()) {
+						skippedStat.Add(iif(msg.ContentType() == "", "<none>", msg.ContentType()).(string), msg.Length)
+						continue
+					}
+					if *interactive {
+						// Messages are published once the user has selected the queues
+						pending = append(pending, msg)
+						continue
+					}
 					publish <- msg
 				}
 			}
 		}
+		progress.Done()
+		if emptyFiles > 0 {
+			errPrintln(color.YellowString("%d empty file(s) without any message", emptyFiles))
+		}
 		for _, qs := range queueStat.List {
 			qtStat.AddGroup(strings.TrimPrefix(filepath.Ext(qs.Name), "."), *qs)
 		}
+		for _, stats := range []*Statistics{&fileStat, &queueStat, &qtStat, &ftStat, &skippedStat, &corruptStat} {
+			stats.Sort(*sortBy, *sortDesc)
+		}
 
 		if mode := *output; mode != "" {
 			switch strings.ToUpper(mode[:1]) {
@@ -444,12 +1233,19 @@ func main() {
 				collections.SetListHelper(json.GenericListHelper)
 				collections.SetDictionaryHelper(json.DictionaryHelper)
 			}
-			print(collections.AsList(map[string]interface{}{
+			result := map[string]interface{}{
 				"Files":      fileStat.GetStats(),
 				"FileTypes":  ftStat.GetStats(),
 				"Queues":     queueStat.GetStats(),
 				"QueueTypes": qtStat.GetStats(),
-			}).PrettyPrint())
+			}
+			if reContentType != nil {
+				result["SkippedContentTypes"] = skippedStat.GetStats()
+			}
+			if skipCorrupt {
+				result["CorruptedMessages"] = corruptStat.GetStats()
+			}
+			print(collections.AsList(result).PrettyPrint())
 		} else {
 			printTable := func(title string, listStat Statistics, group bool) {
 				columns := collections.NewList(title, "Count", "Messages", "Size", "Average", "Minimum", "Maximum")
@@ -484,6 +1280,25 @@ func main() {
 			printTable("Queues", queueStat, false)
 			printTable("Queue Types", qtStat, true)
 			printTable("File Types", ftStat, true)
+			if len(skippedStat.List) > 0 {
+				printTable("Skipped Content Types", skippedStat, false)
+			}
+			if len(corruptStat.List) > 0 {
+				printTable("Corrupted Messages", corruptStat, false)
+			}
+		}
+
+		if *replay && *interactive {
+			selected := selectQueues(queueStat)
+			for _, msg := range pending {
+				if selected[msg.Queue] {
+					publish <- msg
+				}
+			}
+		}
+
+		if len(files) < totalFiles {
+			errPrintln(color.YellowString("Results are limited to %d of %d files", len(files), totalFiles))
 		}
 
 		if publish != nil {
@@ -491,76 +1306,160 @@ func main() {
 		}
 
 		if *replay {
-			for i := 0; i < *threads; i++ {
-				<-completed
+			statuses := make([]publisherStatus, publishers)
+			for i := range statuses {
+				statuses[i] = <-completed
+			}
+			printPublishSummary(pubOptions, statuses...)
+			if *summaryJSON != "" {
+				writeSummaryJSON(*summaryJSON, command, *folder, started, pubOptions, statuses...)
+			}
+			if pubOptions.verifier != nil && !pubOptions.verifier.Verify(statuses...) {
+				exitCode = 1
 			}
 		}
+		progress.Close()
 	}
 
 }
 
-func fileHandler(id int, jobs <-chan string, result chan<- RabbitFile, reMatch *regexp.Regexp) {
+// fileHandler parses the files received from jobs, if join is set, messages spanning two consecutive files are reconstructed
+func fileHandler(id int, jobs <-chan string, result chan<- RabbitFile, reMatch *regexp.Regexp, join bool) {
+	var pending *segmentCarry
 	for file := range jobs {
-		data, err := ReadRabbitFile(file, reMatch)
+		data, err := loadRabbitFile(file, reMatch)
 		if err != nil {
-			errPrintf("Unable to read %s", file)
+			parseFailed(file, err)
+		}
+		if join {
+			data.JoinSegment(pending)
 		}
 		data.ProcessMessages(nil)
+		pending = data.Pending()
 		result <- data
 	}
+	pending.warnIncomplete()
 }
 
-type publisherStatus struct {
-	id        int
-	published map[string]int
+// createOutput creates an output file, the program is stopped if the file cannot be created
+func createOutput(fileName string) *outputFile {
+	file, err := newOutputFile(fileName)
+	if err != nil {
+		abortWrite(fileName, err, 0)
+	}
+	return file
 }
 
-func messageHandler(id int, url string, messages <-chan *RabbitMessage, completed chan publisherStatus, declareQueues bool) {
-	conn := must(amqp.Dial(url)).(*amqp.Connection)
-	defer conn.Close()
-
-	ch := must(conn.Channel()).(*amqp.Channel)
-	defer ch.Close()
+// abortWrite stops the program when an output file cannot be written, so no truncated output is silently produced
+func abortWrite(fileName string, err error, written int) {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOSPC {
+		errPrintln(color.RedString("The disk is full, unable to write %s", fileName))
+	} else {
+		errPrintln(color.RedString("Unable to write %s: %v", fileName, err))
+	}
+	errPrintln(color.RedString("%d messages have been written before the failure, the output folder is incomplete", written))
+	os.Exit(1)
+}
 
-	go func() {
-		returned := ch.NotifyReturn(make(chan amqp.Return, 1))
-		for r := range returned {
-			errPrintln(color.RedString("Returned message"), r.RoutingKey)
-			errPrintln(color.RedString("Error"), r.ReplyText)
-		}
-	}()
+// splitPath returns the relative path of the file where the messages of a queue are written by split-messages
+func splitPath(splitBy string, shards int, fileType, queue string) string {
+	if queue == unknownQueue {
+		queue = unknownBucket
+	}
+	switch splitBy {
+	case "type":
+		return path.Join(fileType, queue)
+	case "shard":
+		hash := fnv.New32a()
+		hash.Write([]byte(queue))
+		return path.Join(fmt.Sprintf("shard-%03d", hash.Sum32()%uint32(shards)), queue)
+	}
+	return queue
+}
 
-	published := make(map[string]int)
+// inspectMessage prints the encoding information of a message with a preview of its decompressed body
+func inspectMessage(msg *RabbitMessage, size int) {
+	preview, err := msg.Decompress(size)
+	var ratio float64
+	if err == nil {
+		ratio, err = msg.CompressionRatio()
+	}
+	if err != nil {
+		errPrintln(color.RedString("%s at %d: unable to decompress %s body: %v", msg.Queue, msg.Position, msg.Encoding(), err))
+		return
+	}
+	errPrintf("%s at %d: %d bytes %s (ratio %.2f) %q\n", msg.Queue, msg.Position, len(msg.Data), msg.Encoding(), ratio, preview)
+}
 
-	defer func() {
-		if completed != nil {
-			completed <- publisherStatus{id, published}
+// colorArgs replaces the deprecated boolean forms of --color (without value and --no-color) by --color=always and
+// --color=never, it returns the arguments and the deprecated form found if any
+func colorArgs(args []string) ([]string, string) {
+	var deprecated string
+	result := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(result, args[i:]...), deprecated
 		}
-	}()
-
-	for msg := range messages {
-		if declareQueues {
-			must(ch.QueueDeclare(msg.Queue, true, false, false, false, nil))
+		switch {
+		case arg == "--no-color":
+			arg, deprecated = "--color=never", arg
+		case arg == "--color" && (i+1 == len(args) || !isColorMode(args[i+1])):
+			arg, deprecated = "--color=always", arg
 		}
+		result = append(result, arg)
+	}
+	return result, deprecated
+}
 
-		pub := amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			Body:         msg.Data,
-		}
+// isColorMode determines if the argument following --color is its value
+func isColorMode(value string) bool {
+	switch value {
+	case "auto", "always", "never", "true", "false":
+		return true
+	}
+	return false
+}
 
-		if msg.IsPush() {
-			pub.Headers = map[string]interface{}{
-				"cmf": fmt.Sprintf("{url:%s,method:%s,zip:true}", msg.Queue, msg.Method),
-			}
-		}
+// isTerminal determines if the file is attached to a terminal
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-		if strings.HasSuffix(msg.Queue, "Index.Doc") || strings.HasSuffix(msg.Queue, "SecCluster.Sync") {
-			must(ch.Publish(msg.Queue, "", true, false, pub))
-		} else {
-			must(ch.Publish("", msg.Queue, true, false, pub))
+// selectQueues prints the discovered queues and asks the user which ones should be replayed
+func selectQueues(queueStat Statistics) map[string]bool {
+	table := getTable("#", "Queue name", "Messages", "Size")
+	for i, s := range queueStat.List {
+		table.Append(collections.NewList(i+1, s.Name, s.Messages(), int64(s.Sum())).Strings())
+	}
+	table.Render()
+	fmt.Println()
+
+	selected := make(map[string]bool)
+	fmt.Print("Queues to replay (comma separated numbers or names, * for all): ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	for _, item := range strings.Split(line, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case item == "":
+		case item == "*":
+			for _, s := range queueStat.List {
+				selected[s.Name] = true
+			}
+		default:
+			if i, err := strconv.Atoi(item); err == nil && i > 0 && i <= len(queueStat.List) {
+				selected[queueStat.List[i-1].Name] = true
+			} else if queueStat.index[item] != nil {
+				selected[item] = true
+			} else {
+				errPrintln(color.YellowString("Unknown queue %s ignored", item))
+			}
 		}
-		published[msg.Queue]++
 	}
+	if len(selected) == 0 {
+		errPrintln(color.YellowString("No queue selected, nothing will be replayed"))
+	}
+	return selected
 }
 
 func getTable(columns ...string) *tablewriter.Table {
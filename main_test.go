@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestColorArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		want       []string
+		deprecated string
+	}{
+		{[]string{"--color", "full"}, []string{"--color=always", "full"}, "--color"},
+		{[]string{"full", "--color"}, []string{"full", "--color=always"}, "--color"},
+		{[]string{"--no-color", "full"}, []string{"--color=never", "full"}, "--no-color"},
+		{[]string{"--color", "never", "full"}, []string{"--color", "never", "full"}, ""},
+		{[]string{"--color=auto", "full"}, []string{"--color=auto", "full"}, ""},
+		{[]string{"full", "--", "--color"}, []string{"full", "--", "--color"}, ""},
+	}
+	for _, test := range tests {
+		got, deprecated := colorArgs(test.args)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) || deprecated != test.deprecated {
+			t.Errorf("colorArgs(%q) = %q, %q, expected %q, %q", test.args, got, deprecated, test.want, test.deprecated)
+		}
+	}
+}
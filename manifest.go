@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+)
+
+const manifestFile = "manifest.json"
+
+// manifestEntry contains the inventory of a queue
+type manifestEntry struct {
+	Messages int `json:"messages"`
+	Bytes    int `json:"bytes"`
+}
+
+// manifest is the inventory of the messages found by split-messages
+type manifest struct {
+	RunID  string                    `json:"run_id,omitempty"` // Set with --timestamp-output or --run-id
+	Files  int                       `json:"files"`
+	Queues map[string]*manifestEntry `json:"queues"`
+}
+
+func newManifest() *manifest { return &manifest{Queues: make(map[string]*manifestEntry)} }
+
+// Add registers a message of the given size for a queue
+func (m *manifest) Add(queue string, size int) {
+	entry := m.Queues[queue]
+	if entry == nil {
+		entry = &manifestEntry{}
+		m.Queues[queue] = entry
+	}
+	entry.Messages++
+	entry.Bytes += size
+}
+
+// Write saves the manifest in the folder
+func (m *manifest) Write(folder string) string {
+	fileName := path.Join(folder, manifestFile)
+	must(ioutil.WriteFile(fileName, must(json.MarshalIndent(m, "", "  ")).([]byte), 0644))
+	return fileName
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// memoryGuardInterval is the time waited between two checks of the heap while it is over the limit
+const memoryGuardInterval = 500 * time.Millisecond
+
+// memoryGuard pauses the dispatching of new files while the heap is over the limit set by --mem-limit
+type memoryGuard struct {
+	limit uint64 // Heap size in bytes, a nil guard never pauses
+}
+
+func newMemoryGuard(limitMB int) *memoryGuard {
+	if limitMB <= 0 {
+		return nil
+	}
+	return &memoryGuard{limit: uint64(limitMB) << 20}
+}
+
+// Wait returns once the heap is under the limit, or when nothing is being processed since the memory could not
+// be released by waiting (busy reports if some files are still being processed).
+func (g *memoryGuard) Wait(busy func() bool) {
+	if g == nil {
+		return
+	}
+	var stats runtime.MemStats
+	for paused := false; ; paused = true {
+		runtime.ReadMemStats(&stats)
+		if stats.HeapAlloc < g.limit {
+			if paused {
+				errPrintln(color.GreenString("Heap back to %d MB, resuming", stats.HeapAlloc>>20))
+			}
+			return
+		}
+		if !busy() {
+			if paused {
+				errPrintln(color.YellowString("Heap still at %d MB over --mem-limit with no file in progress, resuming anyway", stats.HeapAlloc>>20))
+			}
+			return
+		}
+		if !paused {
+			errPrintln(color.YellowString("Heap at %d MB over --mem-limit, pausing the parsing of new files", stats.HeapAlloc>>20))
+		}
+		debug.FreeOSMemory()
+		time.Sleep(memoryGuardInterval)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// segmentMessages is the number of messages of a queue found in a segment file
+type segmentMessages struct {
+	File     string `json:"file"`
+	Segment  *int   `json:"segment,omitempty"`
+	Messages int    `json:"messages"`
+}
+
+// queueSegments lists the segment files that contained the messages of a queue
+// Gaps are the files scanned between the first and the last segment of the queue (in the same folder) without any
+// of its messages, they are the first candidates when looking for lost messages.
+type queueSegments struct {
+	Queue    string            `json:"queue"`
+	Messages int               `json:"messages"`
+	Segments []segmentMessages `json:"segments"`
+	Gaps     []string          `json:"gaps,omitempty"`
+}
+
+// offsetReport retains the file dimension of the queue statistics
+type offsetReport struct {
+	files  []string
+	queues map[string]*queueSegments
+}
+
+func newOffsetReport() *offsetReport {
+	return &offsetReport{queues: make(map[string]*queueSegments)}
+}
+
+// Add records the messages of each queue found in a parsed file
+func (r *offsetReport) Add(file *RabbitFile) {
+	r.files = append(r.files, file.Name())
+	for _, stat := range file.Queues.List {
+		queue := r.queues[stat.Name]
+		if queue == nil {
+			queue = &queueSegments{Queue: stat.Name}
+			r.queues[stat.Name] = queue
+		}
+		segment := segmentMessages{File: file.Name(), Messages: stat.Messages()}
+		if number, ok := segmentNumber(file.Name()); ok {
+			segment.Segment = &number
+		}
+		queue.Segments = append(queue.Segments, segment)
+		queue.Messages += stat.Messages()
+	}
+}
+
+// Queues returns the queues sorted by name, their segments are sorted by folder and segment number
+func (r *offsetReport) Queues() []*queueSegments {
+	order := append([]string{}, r.files...)
+	sortSegments(order)
+	rank := make(map[string]int, len(order))
+	for i, file := range order {
+		rank[file] = i
+	}
+
+	result := make([]*queueSegments, 0, len(r.queues))
+	for _, queue := range r.queues {
+		sort.Slice(queue.Segments, func(i, j int) bool { return rank[queue.Segments[i].File] < rank[queue.Segments[j].File] })
+		queue.Gaps = nil
+		for i := 1; i < len(queue.Segments); i++ {
+			previous, current := queue.Segments[i-1].File, queue.Segments[i].File
+			if filepath.Dir(previous) != filepath.Dir(current) {
+				continue
+			}
+			for _, file := range order[rank[previous]+1 : rank[current]] {
+				queue.Gaps = append(queue.Gaps, file)
+			}
+		}
+		result = append(result, queue)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Queue < result[j].Queue })
+	return result
+}
+
+// Print renders the report on stdout as a table or as json
+func (r *offsetReport) Print(format string) error {
+	queues := r.Queues()
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(queues)
+	}
+
+	// The folder is only displayed if the files come from several folders
+	folders := make(map[string]bool)
+	for _, file := range r.files {
+		folders[filepath.Dir(file)] = true
+	}
+	label := func(file string) string {
+		if len(folders) > 1 {
+			return filepath.Join(filepath.Base(filepath.Dir(file)), filepath.Base(file))
+		}
+		return filepath.Base(file)
+	}
+
+	table := getTable("Queue", "Files", "Messages", "Segments (file:messages)", "Gaps")
+	for _, queue := range queues {
+		segments := make([]string, len(queue.Segments))
+		for i, segment := range queue.Segments {
+			segments[i] = fmt.Sprintf("%s:%d", label(segment.File), segment.Messages)
+		}
+		gaps := make([]string, len(queue.Gaps))
+		for i, gap := range queue.Gaps {
+			gaps[i] = label(gap)
+		}
+		table.Append([]string{queue.Queue, fmt.Sprint(len(queue.Segments)), fmt.Sprint(queue.Messages), strings.Join(segments, ", "), strings.Join(gaps, ", ")})
+	}
+	table.Render()
+	return nil
+}
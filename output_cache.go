@@ -0,0 +1,76 @@
+package main
+
+import "container/list"
+
+// outputCache keeps the output files open between writes, the least recently used files are closed once more than
+// max files are open (max <= 0 means no limit) and reopened in append mode when they are used again.
+type outputCache struct {
+	max   int
+	open  map[string]*list.Element
+	lru   *list.List
+	names map[string]string // Name on disk of the files that have been created
+}
+
+type cachedOutput struct {
+	key  string
+	file *outputFile
+}
+
+func newOutputCache(max int) *outputCache {
+	return &outputCache{max: max, open: make(map[string]*list.Element), lru: list.New(), names: make(map[string]string)}
+}
+
+// Get returns the output file for the path, the file is created on first use
+func (c *outputCache) Get(path string) (*outputFile, error) {
+	if element := c.open[path]; element != nil {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cachedOutput).file, nil
+	}
+	if c.max > 0 && c.lru.Len() >= c.max {
+		if err := c.Release(c.lru.Back().Value.(*cachedOutput).key); err != nil {
+			return nil, err
+		}
+	}
+	var file *outputFile
+	var err error
+	if name, created := c.names[path]; created {
+		file, err = reopenOutputFile(name)
+	} else if file, err = newOutputFile(path); err == nil {
+		c.names[path] = file.Name()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.open[path] = c.lru.PushFront(&cachedOutput{key: path, file: file})
+	return file, nil
+}
+
+// Release closes the output file of the path if it is open
+func (c *outputCache) Release(path string) error {
+	element := c.open[path]
+	if element == nil {
+		return nil
+	}
+	c.lru.Remove(element)
+	delete(c.open, path)
+	return element.Value.(*cachedOutput).file.Close()
+}
+
+// Close closes all the open files
+func (c *outputCache) Close() error {
+	for path := range c.open {
+		if err := c.Release(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names returns the name on disk of all the files that have been created
+func (c *outputCache) Names() []string {
+	result := make([]string, 0, len(c.names))
+	for _, name := range c.names {
+		result = append(result, name)
+	}
+	return result
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/coveooss/gotemplate/v3/collections"
+	"github.com/streadway/amqp"
+)
+
+// queueMap associates a value to the queues read from a file (json, yaml or hcl)
+// Queue names are matched exactly first, then as anchored regular expressions in alphabetical order.
+type queueMap struct {
+	exact    map[string]string
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// readQueueMap loads a file mapping queue names or regular expressions to values
+func readQueueMap(fileName string) (*queueMap, error) {
+	var data map[string]interface{}
+	if err := collections.ConvertData(string(must(ioutil.ReadFile(fileName)).([]byte)), &data); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %v", fileName, err)
+	}
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := &queueMap{exact: make(map[string]string)}
+	for _, key := range keys {
+		value := fmt.Sprint(data[key])
+		result.exact[key] = value
+		re, err := regexp.Compile("^(?:" + key + ")$")
+		if err != nil {
+			// Not a valid expression, the key is only used as an exact name
+			continue
+		}
+		result.patterns = append(result.patterns, re)
+		result.values = append(result.values, value)
+	}
+	return result, nil
+}
+
+// Lookup returns the value of the queue, false if the queue is not in the map (or the map is nil)
+func (m *queueMap) Lookup(queue string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if value, ok := m.exact[queue]; ok {
+		return value, true
+	}
+	for i, re := range m.patterns {
+		if re.MatchString(queue) {
+			return m.values[i], true
+		}
+	}
+	return "", false
+}
+
+// Values returns the distinct values of the map in alphabetical order (nothing if the map is nil)
+func (m *queueMap) Values() []string {
+	if m == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var values []string
+	for _, value := range m.exact {
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// persistenceMap determines the delivery mode used to publish the messages of each queue
+type persistenceMap struct {
+	*queueMap
+}
+
+// readPersistenceMap loads a file (json, yaml or hcl) mapping queue names or regular expressions to persistent or transient
+func readPersistenceMap(fileName string) (*persistenceMap, error) {
+	queues, err := readQueueMap(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(queues.exact))
+	for key := range queues.exact {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := parseDeliveryMode(queues.exact[key]); !ok {
+			return nil, fmt.Errorf("Invalid persistence %q for %s in %s, expected persistent or transient", strings.ToLower(queues.exact[key]), key, fileName)
+		}
+	}
+	return &persistenceMap{queues}, nil
+}
+
+func parseDeliveryMode(value string) (uint8, bool) {
+	switch strings.ToLower(value) {
+	case "persistent":
+		return amqp.Persistent, true
+	case "transient":
+		return amqp.Transient, true
+	}
+	return 0, false
+}
+
+// DeliveryMode returns the delivery mode of the queue, persistent if the queue is not in the map (or the map is nil)
+func (m *persistenceMap) DeliveryMode(queue string) uint8 {
+	if m == nil {
+		return amqp.Persistent
+	}
+	if value, ok := m.Lookup(queue); ok {
+		mode, _ := parseDeliveryMode(value)
+		return mode
+	}
+	return amqp.Persistent
+}
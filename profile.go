@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profiler writes the CPU and memory profiles requested by --cpuprofile and --memprofile
+type profiler struct {
+	cpu     *os.File
+	memPath string
+}
+
+func startProfiling(cpuPath, memPath string) (*profiler, error) {
+	p := &profiler{memPath: memPath}
+	if cpuPath != "" {
+		file, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		p.cpu = file
+	}
+	return p, nil
+}
+
+// Stop flushes the profiles, it is called on every exit path of main (including the recovery of a panic)
+func (p *profiler) Stop() {
+	if p == nil {
+		return
+	}
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		p.cpu.Close()
+		p.cpu = nil
+	}
+	if p.memPath != "" {
+		file, err := os.Create(p.memPath)
+		if err == nil {
+			// Get up-to-date statistics of the live objects
+			runtime.GC()
+			err = pprof.WriteHeapProfile(file)
+			file.Close()
+		}
+		if err != nil {
+			errPrintln(fmt.Sprintf("Unable to write memory profile %s: %v", p.memPath, err))
+		}
+		p.memPath = ""
+	}
+}
+
+// withWorkerLabel runs the function with a profiler label identifying the worker, so the samples could be split by thread
+func withWorkerLabel(kind string, id int, f func()) {
+	pprof.Do(context.Background(), pprof.Labels(kind, fmt.Sprint(id)), func(context.Context) { f() })
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	progressRefresh = 500 * time.Millisecond
+	progressEvents  = time.Second
+)
+
+// progressIndicator reports the number of files and messages processed so far on stderr
+type progressIndicator struct {
+	total     int32
+	files     int32
+	messages  int64
+	bytes     int64
+	published int64
+	returned  int64
+	started   time.Time
+	last      int64
+	enabled   bool
+	terminal  bool
+	events    *json.Encoder
+	stop      chan bool
+	stopped   sync.WaitGroup
+}
+
+// progressEvent is the machine readable progress written with --progress-json
+type progressEvent struct {
+	Time       time.Time `json:"time"`
+	FilesDone  int32     `json:"files_done"`
+	FilesTotal int       `json:"files_total"`
+	Messages   int64     `json:"messages"`
+	Bytes      int64     `json:"bytes"`
+	Published  int64     `json:"published"`
+	Returned   int64     `json:"returned"`
+	Elapsed    float64   `json:"elapsed_seconds"`
+	Done       bool      `json:"done"`
+}
+
+func newProgressIndicator(total int, enabled bool) *progressIndicator {
+	return &progressIndicator{total: int32(total), started: time.Now(), enabled: enabled, terminal: isTerminal(os.Stderr)}
+}
+
+// Add records a processed file with its messages, it is safe to call from multiple goroutines
+func (p *progressIndicator) Add(messages int, bytes float64) {
+	files := atomic.AddInt32(&p.files, 1)
+	atomic.AddInt64(&p.messages, int64(messages))
+	atomic.AddInt64(&p.bytes, int64(bytes))
+	if !p.enabled {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.last)
+	if files < atomic.LoadInt32(&p.total) && now-last < int64(progressRefresh) || !atomic.CompareAndSwapInt64(&p.last, last, now) {
+		return
+	}
+	p.print()
+}
+
+// AddTotal increases the number of files to process, it is used when new files are found by --watch
+func (p *progressIndicator) AddTotal(files int) {
+	atomic.AddInt32(&p.total, int32(files))
+}
+
+// AddPublished records messages published to the broker (nothing is done if the indicator is nil)
+func (p *progressIndicator) AddPublished(count int) {
+	if p != nil {
+		atomic.AddInt64(&p.published, int64(count))
+	}
+}
+
+// AddReturned records messages returned by the broker (nothing is done if the indicator is nil)
+func (p *progressIndicator) AddReturned(count int) {
+	if p != nil {
+		atomic.AddInt64(&p.returned, int64(count))
+	}
+}
+
+// EmitJSON writes a progress event to writer every second until Close is called
+func (p *progressIndicator) EmitJSON(writer io.Writer) {
+	p.events = json.NewEncoder(writer)
+	p.stop = make(chan bool)
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(progressEvents)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.emit(false)
+			case <-p.stop:
+				p.emit(true)
+				return
+			}
+		}
+	}()
+}
+
+// Close writes the final progress event, it must be called once all messages have been published
+func (p *progressIndicator) Close() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stopped.Wait()
+		p.stop = nil
+	}
+}
+
+func (p *progressIndicator) emit(done bool) {
+	p.events.Encode(progressEvent{
+		Time:       time.Now().UTC(),
+		FilesDone:  atomic.LoadInt32(&p.files),
+		FilesTotal: int(atomic.LoadInt32(&p.total)),
+		Messages:   atomic.LoadInt64(&p.messages),
+		Bytes:      atomic.LoadInt64(&p.bytes),
+		Published:  atomic.LoadInt64(&p.published),
+		Returned:   atomic.LoadInt64(&p.returned),
+		Elapsed:    time.Since(p.started).Seconds(),
+		Done:       done,
+	})
+}
+
+// openProgressJSON opens the destination of the progress events, either a file or an open descriptor (fd:N)
+func openProgressJSON(target string) (io.WriteCloser, error) {
+	if strings.HasPrefix(target, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid file descriptor %s", target)
+		}
+		return os.NewFile(uintptr(fd), target), nil
+	}
+	return os.Create(target)
+}
+
+// Done terminates the progress line
+func (p *progressIndicator) Done() {
+	if p.enabled && p.terminal {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progressIndicator) print() {
+	line := color.GreenString("Files %d/%d, %d messages, %d bytes (%v)", atomic.LoadInt32(&p.files), atomic.LoadInt32(&p.total), atomic.LoadInt64(&p.messages), atomic.LoadInt64(&p.bytes), time.Since(p.started).Round(time.Second))
+	if p.terminal {
+		// Overwrite the current line
+		fmt.Fprint(os.Stderr, "\r"+line)
+	} else {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// defaultExchangeName is the name given to the default exchange by the management API
+const defaultExchangeName = "amq.default"
+
+// httpPublisher publishes messages through the RabbitMQ management HTTP API
+type httpPublisher struct {
+	client   *http.Client
+	url      string
+	user     string
+	password string
+	vhost    string
+	limiter  *rateLimiter
+	down     bool // The last publish failed after all its retries, the next one is only tried once
+}
+
+// newHTTPPublisher creates a publisher limited to rate messages per second (0 means unlimited)
+func newHTTPPublisher(managementURL, user, password, vhost string, rate int) *httpPublisher {
+	return &httpPublisher{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		url:      strings.TrimSuffix(managementURL, "/"),
+		user:     user,
+		password: password,
+		vhost:    vhost,
+		limiter:  newRateLimiter(rate),
+	}
+}
+
+// Publish posts a message to the exchange and returns whether it has been routed to at least one queue
+func (p *httpPublisher) Publish(exchange, routingKey string, deliveryMode uint8, msg *RabbitMessage) (bool, error) {
+	p.limiter.Wait()
+
+	if exchange == "" {
+		exchange = defaultExchangeName
+	}
+	properties := map[string]interface{}{"delivery_mode": deliveryMode}
+	if msg.Properties != nil && msg.Properties.Expiration != "" {
+		properties["expiration"] = msg.Properties.Expiration
+	}
+	if priority := msg.Priority(); priority > 0 {
+		properties["priority"] = priority
+	}
+	if msg.IsPush() {
+		properties["headers"] = map[string]string{"cmf": fmt.Sprintf("{url:%s,method:%s,zip:true}", msg.Queue, msg.Method)}
+	}
+	body := must(json.Marshal(map[string]interface{}{
+		"properties":       properties,
+		"routing_key":      routingKey,
+		"payload":          base64.StdEncoding.EncodeToString(msg.Data),
+		"payload_encoding": "base64",
+	})).([]byte)
+
+	endpoint := fmt.Sprintf("%s/api/exchanges/%s/%s/publish", p.url, url.PathEscape(p.vhost), url.PathEscape(exchange))
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.SetBasicAuth(p.user, p.password)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, httpStatusError{endpoint, response.Status, response.StatusCode, strings.TrimSpace(string(content))}
+	}
+	var result struct {
+		Routed bool `json:"routed"`
+	}
+	if err := json.Unmarshal(content, &result); err != nil {
+		return false, fmt.Errorf("Invalid response from %s: %v", endpoint, err)
+	}
+	return result.Routed, nil
+}
+
+// publishRetrying publishes a message, the publishes that fail because of the network or of the server are retried
+// with an exponential backoff (up to retries times)
+func (p *httpPublisher) publishRetrying(retries int, exchange, routingKey string, deliveryMode uint8, msg *RabbitMessage) (bool, error) {
+	routed, err := p.Publish(exchange, routingKey, deliveryMode, msg)
+	if p.down {
+		retries = 0
+	}
+	for attempt := 1; err != nil && isRetryable(err) && attempt <= retries; attempt++ {
+		delay := backoff(attempt)
+		errPrintln(color.YellowString("Unable to publish to %s through %s (%v), retrying in %v (attempt %d of %d)", publishedTo(exchange, routingKey), p.url, err, delay, attempt, retries))
+		time.Sleep(delay)
+		routed, err = p.Publish(exchange, routingKey, deliveryMode, msg)
+	}
+	p.down = err != nil && isRetryable(err)
+	return routed, err
+}
+
+// httpStatusError is returned by Publish when the management API answers with an error status
+type httpStatusError struct {
+	endpoint, status string
+	code             int
+	content          string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("%s returned %s: %s", e.endpoint, e.status, e.content)
+}
+
+// isRetryable determines if a publish could succeed if attempted again (the request errors are not retried)
+func isRetryable(err error) bool {
+	if status, ok := err.(httpStatusError); ok {
+		return status.code >= http.StatusInternalServerError || status.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// readExportLine decodes a line of a find-lost output (the queue is the file name) or of a NDJSON export produced by dump
+// With the binary encoding, the line is the body of a binary record.
+func readExportLine(fileName, line, encoding string) (*RabbitMessage, error) {
+	if encoding == bodyBinary {
+		queue, _ := splitChunk(fileName)
+		return &RabbitMessage{Queue: filepath.Base(queue), Data: []byte(line)}, nil
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		data, err := decodeBody(encoding, line)
+		queue, _ := splitChunk(fileName)
+		return &RabbitMessage{Queue: filepath.Base(queue), Data: data}, err
+	}
+	var record dumpRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil, err
+	}
+	if record.Body == "" {
+		return nil, fmt.Errorf("No body for message at position %d of %s (dumped with --headers-only?)", record.Position, record.File)
+	}
+	data, err := decodeBody(encoding, record.Body)
+	msg := &RabbitMessage{Queue: record.Queue, Data: data, Method: record.Method, File: record.File, Position: record.Position}
+	if record.MessageID != "" {
+		msg.Properties = &MessageProperties{MessageID: record.MessageID, ContentType: record.ContentType}
+	}
+	return msg, err
+}
+
+// publishHTTP publishes the content of the files through the management API
+// Messages that are not routed to any queue are reported as returned.
+func publishHTTP(options publisherOptions, publisher *httpPublisher, encoding string, files []string) publisherStatus {
+	status := newPublisherStatus(0)
+	pacer := publishPacer{scale: options.timeScale}
+	for _, fileName := range files {
+		fmt.Println("Processing file", fileName)
+		func() {
+			file := must(os.Open(fileName)).(*os.File)
+			defer file.Close()
+
+			reader, _ := openDecompressed(file)
+			for lineNo := 1; ; lineNo++ {
+				line, _, err := readRecord(reader, encoding)
+				if corrupt, ok := err.(corruptRecord); ok {
+					errPrintln(color.RedString("Record %d of %s skipped: %v", lineNo, fileName, corrupt))
+					runErrors.Add(errorDecode, corrupt, fileName, "", lineNo)
+					if corrupt.truncated {
+						break
+					}
+					continue
+				}
+				if err == io.EOF && line == "" {
+					break
+				}
+				if encoding != bodyBinary && strings.TrimSpace(line) == "" {
+					continue
+				}
+				msg, decodeErr := readExportLine(fileName, line, encoding)
+				if decodeErr != nil {
+					errPrintln(color.RedString("Unable to decode line %d of %s: %v", lineNo, fileName, decodeErr))
+					runErrors.Add(errorDecode, decodeErr, fileName, "", lineNo)
+					continue
+				}
+
+				target := options.target(msg)
+				if options.logged != nil && options.logged.Contains(msg) {
+					status.skipped[target]++
+					continue
+				}
+				if options.dropExpired && msg.Properties.Expired(time.Now()) {
+					status.expired[target]++
+					continue
+				}
+				if options.filterMethod(msg, target, status) {
+					continue
+				}
+				exchange, routingKey := "", target
+				if options.toExchange(msg) {
+					exchange, routingKey = target, msg.ExchangeRoutingKey()
+				}
+				data := msg.Data
+				body, modified := options.transformBody(msg)
+				if !options.budget.Take(len(body)) {
+					status.limited[target]++
+					continue
+				}
+				if modified {
+					status.modified[target]++
+					msg.Data = body
+				}
+				pacer.Wait(msg.Properties)
+				routed, publishErr := publisher.publishRetrying(options.retries, exchange, routingKey, options.persistence.DeliveryMode(msg.Queue), msg)
+				switch {
+				case publishErr != nil:
+					errPrintln(color.RedString("Unable to publish line %d of %s to %s: %v", lineNo, fileName, target, publishErr))
+					runErrors.Add(errorPublish, publishErr, fileName, target, lineNo)
+					status.failed[target]++
+					// The message could be replayed from the dead letters
+					if err := options.deadLetters.Write(msg.Queue, data); err != nil {
+						abortWrite(options.deadLetters.folder, err, 0)
+					}
+				case routed:
+					status.published[target]++
+					status.bytes[target] += len(body)
+				default:
+					status.returned[target]++
+				}
+				if options.log != nil && publishErr == nil {
+					options.log.Write(replayLogRecord{
+						Time:       time.Now(),
+						Queue:      target,
+						Exchange:   exchange,
+						RoutingKey: routingKey,
+						Hash:       msg.Hash(),
+						MessageID:  msg.MessageID(),
+					})
+				}
+				if err == io.EOF {
+					break
+				}
+			}
+		}()
+	}
+	return status
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublishHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		response   string
+		wantRouted bool
+		wantErr    bool
+	}{
+		{"Routed", http.StatusOK, `{"routed":true}`, true, false},
+		{"Not routed", http.StatusOK, `{"routed":false}`, false, false},
+		{"Missing exchange", http.StatusNotFound, `{"error":"Object Not Found"}`, false, true},
+		{"Invalid response", http.StatusOK, `<html>`, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path, routingKey string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					RoutingKey string `json:"routing_key"`
+				}
+				json.NewDecoder(r.Body).Decode(&request)
+				path, routingKey = r.URL.EscapedPath(), request.RoutingKey
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			publisher := newHTTPPublisher(server.URL, "guest", "guest", "/", 0)
+			routed, err := publisher.Publish("", "q.one", amqp.Persistent, &RabbitMessage{Queue: "q.one", Data: []byte("body")})
+			if routed != test.wantRouted || (err != nil) != test.wantErr {
+				t.Errorf("Publish() = %v, %v, expected %v and an error: %v", routed, err, test.wantRouted, test.wantErr)
+			}
+			if path != "/api/exchanges/%2F/"+defaultExchangeName+"/publish" || routingKey != "q.one" {
+				t.Errorf("Posted to %s with routing key %q", path, routingKey)
+			}
+		})
+	}
+}
+
+func TestPublishHTTPRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int // Status returned to each request, the following ones succeed
+		wantErr    bool
+		wantPosted int
+	}{
+		{"Success", nil, false, 1},
+		{"Server error retried", []int{http.StatusServiceUnavailable}, false, 2},
+		{"Server errors exhausting the retries", []int{http.StatusInternalServerError, http.StatusBadGateway}, true, 2},
+		{"Missing exchange not retried", []int{http.StatusNotFound}, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var posted int
+			var routingKey string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request struct {
+					RoutingKey string `json:"routing_key"`
+				}
+				json.NewDecoder(r.Body).Decode(&request)
+				routingKey = request.RoutingKey
+				if posted++; posted <= len(test.statuses) {
+					w.WriteHeader(test.statuses[posted-1])
+					return
+				}
+				w.Write([]byte(`{"routed":true}`))
+			}))
+			defer server.Close()
+
+			publisher := newHTTPPublisher(server.URL, "guest", "guest", "/", 0)
+			msg := &RabbitMessage{Queue: "ex.topic", RoutingKey: "key.one", Data: []byte("body")}
+			routed, err := publisher.publishRetrying(1, "ex.topic", msg.ExchangeRoutingKey(), 2, msg)
+			if (err != nil) != test.wantErr || routed == test.wantErr {
+				t.Errorf("publishRetrying() = %v, %v", routed, err)
+			}
+			if posted != test.wantPosted || routingKey != "key.one" {
+				t.Errorf("Posted %d times with routing key %q, expected %d with key.one", posted, routingKey, test.wantPosted)
+			}
+		})
+	}
+}
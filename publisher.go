@@ -0,0 +1,846 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/streadway/amqp"
+)
+
+type publisherStatus struct {
+	id        int
+	published map[string]int
+	returned  map[string]int
+	fallback  map[string]int
+	skipped   map[string]int
+	expired   map[string]int
+	modified  map[string]int
+	limited   map[string]int
+	filtered  map[string]int // Messages skipped by --method-match or --method-exclude by queue
+	methods   map[string]int // Messages skipped by --method-match or --method-exclude by method
+	failed    map[string]int // Messages not published to enough targets by queue
+	nacked    map[string]int // Messages refused by the broker by queue (--confirm)
+	delivered map[string]int // Messages published by target cluster
+	rejected  map[string]int // Messages that could not be published by target cluster
+	bytes     map[string]int // Size of the bodies published by queue
+}
+
+func newPublisherStatus(id int) publisherStatus {
+	return publisherStatus{
+		id:        id,
+		published: make(map[string]int),
+		returned:  make(map[string]int),
+		fallback:  make(map[string]int),
+		skipped:   make(map[string]int),
+		expired:   make(map[string]int),
+		modified:  make(map[string]int),
+		limited:   make(map[string]int),
+		filtered:  make(map[string]int),
+		methods:   make(map[string]int),
+		failed:    make(map[string]int),
+		nacked:    make(map[string]int),
+		delivered: make(map[string]int),
+		rejected:  make(map[string]int),
+		bytes:     make(map[string]int),
+	}
+}
+
+// byteBudget limits the total size of the message bodies published by all publishers
+type byteBudget struct {
+	max  int64
+	used int64
+}
+
+// Take reserves the size of a message, it returns false once the budget has been reached (always true if the budget is nil)
+// The message that crosses the limit is still published, so the budget is reached rather than never used completely.
+func (b *byteBudget) Take(size int) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used >= b.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+int64(size)) {
+			return true
+		}
+	}
+}
+
+// Exhausted determines if no more messages would be published
+func (b *byteBudget) Exhausted() bool { return b != nil && atomic.LoadInt64(&b.used) >= b.max }
+
+// rateLimiter limits the number of messages published per second by all publishers
+// Each message reserves the next slot of the schedule, a publisher waits for its slot before reserving another one,
+// so the publishers are served in turn and none of them can take the slots of the others.
+type rateLimiter struct {
+	interval time.Duration
+	lock     sync.Mutex
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter of rate messages per second, nil (unlimited) if rate <= 0
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(rate)}
+}
+
+// Wait sleeps until the next message could be published (nothing is done if the limiter is nil)
+func (l *rateLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		// The unused slots are not accumulated, so there is no burst after an idle period
+		l.next = now
+	}
+	slot := l.next
+	l.next = slot.Add(l.interval)
+	l.lock.Unlock()
+	time.Sleep(time.Until(slot))
+}
+
+// Values of --on-declare-conflict
+const (
+	declareConflictSkip = "skip" // Publish to the existing queue
+	declareConflictFail = "fail" // Count the messages of the queue as failed
+)
+
+// publisherOptions holds the settings shared by all publishers
+type publisherOptions struct {
+	urls            []string // Urls of the clusters where every message is published
+	requireAll      bool     // A message is failed unless it has been published to all the clusters
+	protocol        string
+	declareQueues   bool
+	onConflict      string // Handling of the queues that already exist with different properties (skip or fail)
+	isExchange      bool
+	fallback        bool
+	mandatory       bool
+	immediate       bool
+	confirm         bool // Wait for the broker to confirm each message
+	prefix          string
+	suffix          string
+	log             *replayLog
+	logged          *replayLogIndex
+	verifier        *queueVerifier
+	dropExpired     bool
+	transforms      []bodyTransform
+	persistence     *persistenceMap
+	timeScale       float64 // Multiplier applied to the original spacing of the messages, 0 means no pacing
+	progress        *progressIndicator
+	budget          *byteBudget
+	limiter         *rateLimiter // Shared by all publishers (--rate)
+	retries         int          // Number of reconnections attempted when a publish, connection or declaration fails
+	deadLetters     *deadLetters
+	maxPriority     int // x-max-priority of the declared queues, 0 means no priority
+	sink            string
+	kafka           kafkaOptions
+	methodMatch     *regexp.Regexp
+	methodExclude   *regexp.Regexp
+	vhosts          *queueMap // Vhost of the queues, the messages of the other queues are published to the vhost of the url
+	faithful        bool      // Publish to the original exchange with the original routing key and properties
+	preserveHeaders bool      // Republish the original headers of the messages
+	preserveProps   bool      // Republish the original properties (including the headers) of the messages
+	warmup          *publisherWarmup
+	outcome         func(msg *RabbitMessage, delivered bool) // Called once each message is handled, delivered if published or dead lettered
+}
+
+// publisherWarmup opens the connections of the publishers (and declares the known queues) before the first message
+type publisherWarmup struct {
+	queues  []string // Queues declared up front with --declare-queues
+	started time.Time
+	pending int32
+	elapsed time.Duration // Time spent until the last publisher was ready
+	ready   sync.WaitGroup
+}
+
+func newPublisherWarmup(publishers int, queues []string) *publisherWarmup {
+	warmup := &publisherWarmup{queues: queues, started: time.Now(), pending: int32(publishers)}
+	warmup.ready.Add(publishers)
+	return warmup
+}
+
+// Done is called by each publisher once connected
+func (w *publisherWarmup) Done() {
+	if atomic.AddInt32(&w.pending, -1) == 0 {
+		w.elapsed = time.Since(w.started)
+	}
+	w.ready.Done()
+}
+
+// Wait blocks until all publishers are connected, it returns the setup time (nothing is done if the warmup is nil)
+func (w *publisherWarmup) Wait() time.Duration {
+	if w == nil {
+		return 0
+	}
+	w.ready.Wait()
+	return w.elapsed
+}
+
+// faithfulProperties copies the original properties of the message that are republished with --faithful-routing or
+// --preserve-properties
+// The user id is not copied since the broker rejects messages whose user id does not match the connection.
+func faithfulProperties(pub *amqp.Publishing, props *MessageProperties) {
+	if props == nil {
+		return
+	}
+	pub.ContentType = props.ContentType
+	pub.ContentEncoding = props.ContentEncoding
+	pub.CorrelationId = props.CorrelationID
+	pub.ReplyTo = props.ReplyTo
+	pub.Type = props.Type
+	pub.AppId = props.AppID
+	pub.Timestamp = props.Timestamp
+	pub.Headers = originalHeaders(props)
+}
+
+// returnedPublishing returns the message returned by the broker with all its properties, to publish it again
+func returnedPublishing(r amqp.Return) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         r.Headers,
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Timestamp:       r.Timestamp,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+		Body:            r.Body,
+	}
+}
+
+// originalHeaders returns a copy of the original headers of the message (nil if there is none)
+// The headers added by the replayer (cmf, attempt) are set on the copy, so they take precedence over the original ones.
+func originalHeaders(props *MessageProperties) amqp.Table {
+	if props == nil || len(props.Headers) == 0 {
+		return nil
+	}
+	headers := make(amqp.Table, len(props.Headers))
+	for key, value := range props.Headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// vhostURL returns the url used to connect to the vhost of the target cluster (the url of the target if vhost is empty)
+func (options publisherOptions) vhostURL(target int, vhost string) string {
+	if vhost == "" {
+		return options.urls[target]
+	}
+	return options.urls[target] + "/" + url.PathEscape(vhost)
+}
+
+// targetName returns the host of the target cluster as displayed in the summary (without credentials)
+func (options publisherOptions) targetName(target int) string {
+	if parsed, err := url.Parse(options.urls[target]); err == nil {
+		return parsed.Host
+	}
+	return fmt.Sprintf("target #%d", target+1)
+}
+
+// unknownMethod is reported for the messages whose method is not known (plain exports do not keep it)
+const unknownMethod = "<unknown>"
+
+// returnsBuffer is the number of returned messages buffered while the previous ones are handled, the channel stops
+// reading the frames of the broker (including the confirmations) while the buffer is full
+const returnsBuffer = 1000
+
+// filterMethod determines if the message must be skipped because of its method, it is counted in the status if so
+func (options publisherOptions) filterMethod(msg *RabbitMessage, target string, status publisherStatus) bool {
+	if options.methodMatch == nil && options.methodExclude == nil {
+		return false
+	}
+	method := msg.Method
+	if method == "" {
+		method = unknownMethod
+	}
+	if options.methodMatch != nil && !options.methodMatch.MatchString(msg.Method) ||
+		options.methodExclude != nil && options.methodExclude.MatchString(msg.Method) {
+		status.filtered[target]++
+		status.methods[method]++
+		return true
+	}
+	return false
+}
+
+// queueArgs returns the arguments used to declare the queues
+func (options publisherOptions) queueArgs() amqp.Table {
+	if options.maxPriority <= 0 {
+		return nil
+	}
+	return amqp.Table{"x-max-priority": int32(options.maxPriority)}
+}
+
+// replayAttemptHeader is added to the messages published again after a reconnection, they may be duplicates
+// if the broker received the original publish before the connection failed.
+const replayAttemptHeader = "x-replay-attempt"
+
+// Time waited before reconnecting to the broker after a failed publish, the delay doubles on each attempt
+const (
+	reconnectDelay    = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// backoff returns the time waited before the reconnection attempt (starting at 1)
+func backoff(attempt int) time.Duration {
+	if attempt > 6 {
+		return maxReconnectDelay
+	}
+	if delay := reconnectDelay << uint(attempt-1); delay < maxReconnectDelay {
+		return delay
+	}
+	return maxReconnectDelay
+}
+
+// withAttempt returns a copy of the headers marked with the attempt number
+func withAttempt(headers amqp.Table, attempt int) amqp.Table {
+	result := amqp.Table{replayAttemptHeader: int32(attempt)}
+	for key, value := range headers {
+		if key != replayAttemptHeader {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// publishPacer delays the publishing of messages to approximate their original spacing
+// The spacing is only meaningful if messages are published in their original order by a single publisher.
+type publishPacer struct {
+	scale    float64
+	previous time.Time
+}
+
+// Wait sleeps for the time elapsed between the previous message and this one (messages without timestamp are not delayed)
+func (p *publishPacer) Wait(props *MessageProperties) {
+	if p.scale <= 0 || props == nil || props.Timestamp.IsZero() {
+		return
+	}
+	if !p.previous.IsZero() && props.Timestamp.After(p.previous) {
+		time.Sleep(time.Duration(float64(props.Timestamp.Sub(p.previous)) * p.scale))
+	}
+	p.previous = props.Timestamp
+}
+
+// describeTarget returns a description of the target broker where messages are published, the password is masked
+func (options publisherOptions) describeTarget(index int) string {
+	onOff := func(value bool) string {
+		if value {
+			return "on"
+		}
+		return "off"
+	}
+	target, err := url.Parse(options.urls[index])
+	if err != nil {
+		return fmt.Sprintf("Invalid target url: %v", err)
+	}
+	masked := target.String()
+	if target.User != nil {
+		// The url is built by hand since the masking characters would be escaped
+		masked = fmt.Sprintf("%s://%s:****@%s%s", target.Scheme, target.User.Username(), target.Host, target.Path)
+	}
+	vhost := strings.TrimPrefix(target.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	return fmt.Sprintf("Publishing to %s (protocol %s, vhost %s, TLS %s, mandatory %s, immediate %s, publisher confirms %s)",
+		masked, options.protocol, vhost, onOff(target.Scheme == "amqps"), onOff(options.mandatory), onOff(options.immediate), onOff(options.confirm))
+}
+
+// target returns the name of the queue or exchange where the message should be published
+func (options publisherOptions) target(msg *RabbitMessage) string {
+	return options.prefix + msg.Queue + options.suffix
+}
+
+// toExchange determines if the message must be published to an exchange rather than directly to a queue
+func (options publisherOptions) toExchange(msg *RabbitMessage) bool {
+	switch msg.Destination {
+	case DestinationExchange:
+		return true
+	case DestinationQueue:
+		return false
+	}
+	return options.isExchange || strings.HasSuffix(msg.Queue, "Index.Doc") || strings.HasSuffix(msg.Queue, "SecCluster.Sync")
+}
+
+func messageHandler(id int, options publisherOptions, messages <-chan *RabbitMessage, completed chan publisherStatus) {
+	status := newPublisherStatus(id)
+	var lock sync.Mutex
+	pacer := publishPacer{scale: options.timeScale}
+
+	// Messages are only returned by the broker if they are published as mandatory, the returns are read until the
+	// publisher is closed. The returned messages are published again to their queue (--fallback-to-queue) with a
+	// publisher of their own: the publishing channel may be waiting for a confirmation, which is only received once
+	// its returns have been dispatched.
+	var watchers sync.WaitGroup
+	var watch func(ch Publisher, target int, vhost string)
+	watchReturns := func(ch Publisher, target int, vhost string) {
+		if !options.mandatory {
+			return
+		}
+		var fallback Publisher
+		defer func() {
+			if fallback != nil {
+				fallback.Close()
+			}
+		}()
+		returned := ch.NotifyReturn(make(chan amqp.Return, returnsBuffer))
+		for r := range returned {
+			if options.fallback && r.Exchange != "" {
+				// The exchange bindings may no longer exist, so we try to publish directly to the queue with the same name
+				var err error
+				if fallback == nil {
+					var publisher Publisher
+					if publisher, err = newPublisher(options, target, vhost); err == nil {
+						fallback = publisher
+						watch(fallback, target, vhost)
+					}
+				}
+				if err == nil {
+					err = fallback.Publish("", r.Exchange, true, false, returnedPublishing(r))
+				}
+				if err == nil {
+					lock.Lock()
+					status.fallback[r.Exchange]++
+					lock.Unlock()
+					continue
+				}
+				errPrintln(color.RedString("Unable to publish the returned message to queue %s: %v", r.Exchange, err))
+				if fallback != nil {
+					fallback.Close()
+					fallback = nil
+				}
+			}
+			errPrintln(color.RedString("Returned message"), r.Exchange, r.RoutingKey)
+			errPrintln(color.RedString("Error"), r.ReplyText)
+			name := r.Exchange
+			if name == "" {
+				name = r.RoutingKey
+			}
+			lock.Lock()
+			status.returned[name]++
+			lock.Unlock()
+			options.progress.AddReturned(1)
+		}
+	}
+	watch = func(ch Publisher, target int, vhost string) {
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			watchReturns(ch, target, vhost)
+		}()
+	}
+
+	// A connection is kept for each target cluster and vhost where messages are published
+	type channelKey struct {
+		target int
+		vhost  string
+	}
+	channels := make(map[channelKey]Publisher)
+	defer func() {
+		// The returns and confirmations are drained before the status is reported, so it is no longer updated
+		for _, ch := range channels {
+			ch.Close()
+		}
+		watchers.Wait()
+		if completed != nil {
+			completed <- status
+		}
+	}()
+	channel := func(target int, vhost string) (Publisher, error) {
+		ch := channels[channelKey{target, vhost}]
+		if ch == nil {
+			var err error
+			if ch, err = newPublisher(options, target, vhost); err != nil {
+				return nil, err
+			}
+			channels[channelKey{target, vhost}] = ch
+			watch(ch, target, vhost)
+		}
+		return ch, nil
+	}
+	reconnect := func(target int, vhost string) (Publisher, error) {
+		if ch := channels[channelKey{target, vhost}]; ch != nil {
+			ch.Close()
+			delete(channels, channelKey{target, vhost})
+		}
+		return channel(target, vhost)
+	}
+	connect := func(target int, vhost string) {
+		if _, err := channel(target, vhost); err != nil {
+			errPrintln(color.YellowString("Unable to connect to %s (%v), the connection is retried with the messages", options.targetName(target), err))
+		}
+	}
+
+	// retry runs an operation on the connection to the target, reconnecting with an exponential backoff while it fails
+	// The operation is not retried if the broker refused it (nack or declaration conflict). Once a target could not
+	// be reached after all the retries, the following operations are only tried once until it is reachable again, so
+	// an unavailable broker does not delay every message.
+	unreachable := make(map[channelKey]bool)
+	retry := func(target int, vhost, what string, operation func(ch Publisher, attempt int) error) error {
+		key := channelKey{target, vhost}
+		ch, err := channel(target, vhost)
+		if err == nil {
+			err = operation(ch, 0)
+		}
+		retries := options.retries
+		if unreachable[key] {
+			retries = 0
+		}
+		for attempt := 1; err != nil && !isNacked(err) && !isDeclareConflict(err) && attempt <= retries; attempt++ {
+			delay := backoff(attempt)
+			errPrintln(color.YellowString("Unable to %s on %s (%v), reconnecting in %v (attempt %d of %d)", what, options.targetName(target), err, delay, attempt, retries))
+			time.Sleep(delay)
+			if ch, err = reconnect(target, vhost); err == nil {
+				err = operation(ch, attempt)
+			}
+		}
+		unreachable[key] = err != nil && ch == nil
+		return err
+	}
+
+	for target := range options.urls {
+		connect(target, "")
+	}
+	// declareQueue declares a queue once per target and vhost, it returns false if the messages of the queue must be
+	// failed because the queue already exists with different properties or could not be declared
+	declared := make(map[channelKey]bool)
+	conflicts := make(map[channelKey]bool)
+	declareQueue := func(target int, vhost, name string) bool {
+		key := channelKey{target, vhost + "/" + name}
+		if declared[key] {
+			return !conflicts[key]
+		}
+		err := retry(target, vhost, "declare queue "+name, func(ch Publisher, _ int) error { return ch.DeclareQueue(name, options.queueArgs()) })
+		switch {
+		case err == nil:
+		case !isDeclareConflict(err):
+			// The declaration is attempted again with the next message of the queue
+			runErrors.Add(errorPublish, fmt.Errorf("%s: %v", options.targetName(target), err), "", name, -1)
+			errPrintln(color.RedString("Unable to declare queue %s on %s (%v), its message is failed", name, options.targetName(target), err))
+			return false
+		case options.onConflict == declareConflictFail:
+			conflicts[key] = true
+			runErrors.Add(errorConflict, err, "", name, -1)
+			errPrintln(color.RedString("Queue %s already exists on %s with different properties (%v), its messages are failed", name, options.targetName(target), err))
+		default:
+			errPrintln(color.YellowString("Queue %s already exists on %s with different properties (%v), publishing to the existing queue", name, options.targetName(target), err))
+		}
+		declared[key] = true
+		return !conflicts[key]
+	}
+	// declareExchange declares an exchange once per target and vhost, it returns false if the exchange could not be
+	// declared
+	declareExchange := func(target int, vhost, name string) bool {
+		key := channelKey{target, vhost + "/" + name}
+		if declared[key] {
+			return true
+		}
+		var created bool
+		err := retry(target, vhost, "declare exchange "+name, func(ch Publisher, _ int) (err error) {
+			created, err = ch.DeclareExchange(name)
+			return
+		})
+		if err != nil {
+			runErrors.Add(errorPublish, fmt.Errorf("%s: %v", options.targetName(target), err), "", name, -1)
+			errPrintln(color.RedString("Unable to declare exchange %s on %s (%v), its message is failed", name, options.targetName(target), err))
+			return false
+		}
+		if created {
+			errPrintln(color.YellowString("Exchange %s did not exist on %s and has been declared as a topic exchange without binding", name, options.targetName(target)))
+		}
+		declared[key] = true
+		return true
+	}
+	if options.warmup != nil {
+		for target := range options.urls {
+			for _, vhost := range options.vhosts.Values() {
+				connect(target, vhost)
+			}
+			if !options.declareQueues {
+				continue
+			}
+			for _, queue := range options.warmup.queues {
+				name := options.target(&RabbitMessage{Queue: queue})
+				vhost, _ := options.vhosts.Lookup(queue)
+				declareQueue(target, vhost, name)
+			}
+		}
+		options.warmup.Done()
+	}
+
+	// publish sends the message to the target, the messages published again after a failed publish are marked with
+	// their attempt since the broker may have received them
+	publish := func(target int, vhost, exchange, routingKey string, pub amqp.Publishing) error {
+		published := false
+		return retry(target, vhost, "publish to "+publishedTo(exchange, routingKey), func(ch Publisher, attempt int) error {
+			if published {
+				pub.Headers = withAttempt(pub.Headers, attempt)
+			}
+			published = true
+			return ch.Publish(exchange, routingKey, options.mandatory, options.immediate, pub)
+		})
+	}
+
+	// handle publishes a message, it returns false if the message has been neither published nor dead lettered (the
+	// messages skipped on purpose are handled)
+	handle := func(msg *RabbitMessage) bool {
+		target := options.target(msg)
+		if options.logged != nil && options.logged.Contains(msg) {
+			status.skipped[target]++
+			return true
+		}
+		if options.dropExpired && msg.Properties.Expired(time.Now()) {
+			status.expired[target]++
+			return true
+		}
+		if options.filterMethod(msg, target, status) {
+			return true
+		}
+		vhost, _ := options.vhosts.Lookup(msg.Queue)
+		faithful := options.faithful && msg.Destination == DestinationExchange
+		undeclared := make([]bool, len(options.urls))
+		for cluster := range options.urls {
+			if options.declareQueues && faithful {
+				undeclared[cluster] = !declareExchange(cluster, vhost, target)
+			} else if options.declareQueues {
+				undeclared[cluster] = !declareQueue(cluster, vhost, target)
+			}
+		}
+
+		body, modified := options.transformBody(msg)
+		if !options.budget.Take(len(body)) {
+			status.limited[target]++
+			return false
+		}
+		if modified {
+			status.modified[target]++
+		}
+		pub := amqp.Publishing{
+			DeliveryMode: options.persistence.DeliveryMode(msg.Queue),
+			MessageId:    msg.ReplayID(),
+			Priority:     msg.Priority(),
+			Body:         body,
+		}
+		if msg.Properties != nil {
+			pub.Expiration = msg.Properties.Expiration
+		}
+		if faithful || options.preserveProps {
+			faithfulProperties(&pub, msg.Properties)
+		} else if options.preserveHeaders {
+			pub.Headers = originalHeaders(msg.Properties)
+		}
+
+		if msg.IsPush() {
+			if pub.Headers == nil {
+				pub.Headers = amqp.Table{}
+			}
+			pub.Headers["cmf"] = fmt.Sprintf("{url:%s,method:%s,zip:true}", msg.Queue, msg.Method)
+		}
+
+		exchange, routingKey := "", target
+		if faithful {
+			exchange, routingKey = target, msg.RoutingKey
+		} else if options.toExchange(msg) {
+			exchange, routingKey = target, msg.ExchangeRoutingKey()
+		} else if options.verifier != nil {
+			options.verifier.Baseline(target)
+		}
+		pacer.Wait(msg.Properties)
+		options.limiter.Wait()
+		var failures int
+		for cluster := range options.urls {
+			if undeclared[cluster] {
+				status.rejected[options.targetName(cluster)]++
+				failures++
+				continue
+			}
+			err := publish(cluster, vhost, exchange, routingKey, pub)
+			if isNacked(err) {
+				errPrintln(color.RedString("Message at %d of %s nacked by %s", msg.Position, msg.File, options.targetName(cluster)))
+				runErrors.Add(errorNack, fmt.Errorf("%s: %v", options.targetName(cluster), err), msg.File, target, msg.Position)
+				status.nacked[target]++
+				status.rejected[options.targetName(cluster)]++
+				failures++
+				continue
+			}
+			if err != nil {
+				errPrintln(color.RedString("Unable to publish message to %s on %s: %v", target, options.targetName(cluster), err))
+				runErrors.Add(errorPublish, fmt.Errorf("%s: %v", options.targetName(cluster), err), msg.File, target, msg.Position)
+				status.rejected[options.targetName(cluster)]++
+				failures++
+				continue
+			}
+			status.delivered[options.targetName(cluster)]++
+		}
+		if failures == len(options.urls) {
+			// The message has not been published anywhere, it could be replayed from the dead letters
+			if err := options.deadLetters.Write(msg.Queue, msg.Data); err != nil {
+				abortWrite(options.deadLetters.folder, err, 0)
+			}
+			status.failed[target]++
+			return options.deadLetters != nil
+		}
+		if failures > 0 && options.requireAll {
+			status.failed[target]++
+			return false
+		}
+		status.published[target]++
+		status.bytes[target] += len(body)
+		options.progress.AddPublished(1)
+		if options.log != nil {
+			options.log.Write(replayLogRecord{
+				Time:       time.Now(),
+				Queue:      target,
+				Exchange:   exchange,
+				RoutingKey: routingKey,
+				Hash:       msg.Hash(),
+				MessageID:  msg.MessageID(),
+			})
+		}
+		return true
+	}
+	for msg := range messages {
+		delivered := handle(msg)
+		if options.outcome != nil {
+			options.outcome(msg, delivered)
+		}
+	}
+}
+
+// printPublishSummary renders the number of messages published by queue for all publishers
+func printPublishSummary(options publisherOptions, statuses ...publisherStatus) {
+	columns := []struct {
+		title   string
+		enabled bool
+		counts  func(publisherStatus) map[string]int
+	}{
+		{"Published", true, func(s publisherStatus) map[string]int { return s.published }},
+		{"Returned", true, func(s publisherStatus) map[string]int { return s.returned }},
+		{"Via fallback", options.fallback, func(s publisherStatus) map[string]int { return s.fallback }},
+		{"Already replayed", options.logged != nil, func(s publisherStatus) map[string]int { return s.skipped }},
+		{"Expired", options.dropExpired, func(s publisherStatus) map[string]int { return s.expired }},
+		{"Modified", len(options.transforms) > 0, func(s publisherStatus) map[string]int { return s.modified }},
+		{"Over byte limit", options.budget != nil, func(s publisherStatus) map[string]int { return s.limited }},
+		{"Filtered by method", options.methodMatch != nil || options.methodExclude != nil, func(s publisherStatus) map[string]int { return s.filtered }},
+		{"Nacked", options.confirm, func(s publisherStatus) map[string]int { return s.nacked }},
+		{"Failed", len(options.urls) > 1 || options.onConflict == declareConflictFail || options.confirm || hasCounts(statuses, func(s publisherStatus) map[string]int { return s.failed }), func(s publisherStatus) map[string]int { return s.failed }},
+	}
+
+	header := []string{"Queue name"}
+	var queues []string
+	seen := make(map[string]bool)
+	totals := make([]map[string]int, len(columns))
+	for i, column := range columns {
+		if column.enabled {
+			header = append(header, column.title)
+		}
+		totals[i] = make(map[string]int)
+		for _, status := range statuses {
+			for queue, count := range column.counts(status) {
+				if !seen[queue] {
+					seen[queue] = true
+					queues = append(queues, queue)
+				}
+				totals[i][queue] += count
+			}
+		}
+	}
+	sort.Strings(queues)
+
+	table := getTable(header...)
+	footer := make([]int, len(columns))
+	for _, queue := range queues {
+		row := []string{queue}
+		for i, column := range columns {
+			if column.enabled {
+				row = append(row, fmt.Sprint(totals[i][queue]))
+			}
+			footer[i] += totals[i][queue]
+		}
+		table.Append(row)
+	}
+	row := []string{""}
+	for i, column := range columns {
+		if column.enabled {
+			row = append(row, fmt.Sprint(footer[i]))
+		}
+	}
+	table.SetFooter(row)
+	table.Render()
+	fmt.Println()
+	printMethodSummary(statuses...)
+	printTargetSummary(options, statuses...)
+	if options.budget.Exhausted() {
+		errPrintln(color.YellowString("Reached --max-total-bytes after publishing %d bytes, remaining messages have not been published", atomic.LoadInt64(&options.budget.used)))
+	}
+}
+
+// hasCounts determines if any publisher has counted a message in the map returned by counts
+func hasCounts(statuses []publisherStatus, counts func(publisherStatus) map[string]int) bool {
+	for _, status := range statuses {
+		if len(counts(status)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// printTargetSummary renders the number of messages published and failed by target cluster if there are several
+func printTargetSummary(options publisherOptions, statuses ...publisherStatus) {
+	if len(options.urls) < 2 {
+		return
+	}
+	table := getTable("Target", "Published", "Failed")
+	for target := range options.urls {
+		name := options.targetName(target)
+		var published, failed int
+		for _, status := range statuses {
+			published += status.delivered[name]
+			failed += status.rejected[name]
+		}
+		table.Append([]string{name, fmt.Sprint(published), fmt.Sprint(failed)})
+	}
+	table.Render()
+	fmt.Println()
+}
+
+// printMethodSummary renders the number of messages skipped by method, if any
+func printMethodSummary(statuses ...publisherStatus) {
+	totals := make(map[string]int)
+	for _, status := range statuses {
+		for method, count := range status.methods {
+			totals[method] += count
+		}
+	}
+	if len(totals) == 0 {
+		return
+	}
+	methods := make([]string, 0, len(totals))
+	for method := range totals {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	table := getTable("Skipped method", "Messages")
+	for _, method := range methods {
+		table.Append([]string{method, fmt.Sprint(totals[method])})
+	}
+	table.Render()
+	fmt.Println()
+}
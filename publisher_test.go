@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    string
+	}{{1, "1s"}, {2, "2s"}, {3, "4s"}, {5, "16s"}, {6, "30s"}, {40, "30s"}}
+	for _, test := range tests {
+		if got := backoff(test.attempt).String(); got != test.want {
+			t.Errorf("backoff(%d) = %s, expected %s", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestPublishWithoutBroker(t *testing.T) {
+	// A port that has just been released, so the connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	folder := t.TempDir()
+	for name, declare := range map[string]bool{"publish": false, "declare": true} {
+		options := publisherOptions{
+			urls:          []string{"amqp://guest:guest@" + listener.Addr().String()},
+			declareQueues: declare,
+			deadLetters:   newDeadLetters(filepath.Join(folder, name), bodyBase64),
+		}
+		messages := make(chan *RabbitMessage, 2)
+		messages <- &RabbitMessage{Queue: "q.one", Destination: DestinationQueue, Data: []byte("first")}
+		messages <- &RabbitMessage{Queue: "q.one", Destination: DestinationQueue, Data: []byte("second")}
+		close(messages)
+		completed := make(chan publisherStatus, 1)
+		messageHandler(0, options, messages, completed)
+		options.deadLetters.Close()
+
+		if status := <-completed; status.failed["q.one"] != 2 || status.published["q.one"] != 0 {
+			t.Errorf("Got %d failed and %d published messages (%s), expected 2 failed", status.failed["q.one"], status.published["q.one"], name)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(options.deadLetters.folder, "q.one"))
+		if err != nil {
+			t.Fatalf("The messages have not been dead lettered: %v", err)
+		}
+		if lines := strings.Fields(string(content)); len(lines) != 2 {
+			t.Errorf("Got %d dead letters, expected 2", len(lines))
+		}
+	}
+}
+
+func TestPublishOutcome(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	for name, deadLetters := range map[string]*deadLetters{"failed": nil, "dead lettered": newDeadLetters(t.TempDir(), bodyBase64)} {
+		var outcomes []bool
+		options := publisherOptions{
+			urls:        []string{"amqp://guest:guest@" + listener.Addr().String()},
+			deadLetters: deadLetters,
+			outcome:     func(msg *RabbitMessage, delivered bool) { outcomes = append(outcomes, delivered) },
+		}
+		messages := make(chan *RabbitMessage, 2)
+		messages <- &RabbitMessage{Queue: "q.one", Destination: DestinationQueue, Data: []byte("first")}
+		messages <- &RabbitMessage{Queue: "q.one", Destination: DestinationQueue, Data: []byte("second")}
+		close(messages)
+		messageHandler(0, options, messages, nil)
+		deadLetters.Close()
+
+		delivered := deadLetters != nil
+		if len(outcomes) != 2 || outcomes[0] != delivered || outcomes[1] != delivered {
+			t.Errorf("Got the outcomes %v for the %s messages, expected 2 times %v", outcomes, name, delivered)
+		}
+	}
+}
+
+func TestReturnedPublishing(t *testing.T) {
+	timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	returned := amqp.Return{
+		ReplyCode: 312, ReplyText: "NO_ROUTE", Exchange: "q.one", RoutingKey: "key",
+		Headers: amqp.Table{"cmf": "{url:q.one}"}, ContentType: "application/json", ContentEncoding: "gzip",
+		DeliveryMode: amqp.Persistent, Priority: 5, CorrelationId: "correlation", ReplyTo: "replies",
+		Expiration: "60000", MessageId: "id", Timestamp: timestamp, Type: "created", UserId: "guest", AppId: "app",
+		Body: []byte("hello"),
+	}
+	expected := amqp.Publishing{
+		Headers: amqp.Table{"cmf": "{url:q.one}"}, ContentType: "application/json", ContentEncoding: "gzip",
+		DeliveryMode: amqp.Persistent, Priority: 5, CorrelationId: "correlation", ReplyTo: "replies",
+		Expiration: "60000", MessageId: "id", Timestamp: timestamp, Type: "created", UserId: "guest", AppId: "app",
+		Body: []byte("hello"),
+	}
+	if pub := returnedPublishing(returned); !reflect.DeepEqual(pub, expected) {
+		t.Errorf("returnedPublishing() = %+v, expected %+v", pub, expected)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fatih/color"
+)
+
+// Layout of the classic queue index files (rabbit_queue_index)
+const (
+	indexSegmentEntries = 16384         // Entries of a segment file, the sequence id is segment * entries + relative sequence
+	indexPubBodyBytes   = 16 + 8 + 4    // Message id, expiry and size following the prefix of a publish record
+	indexJournalFile    = "journal.jif" // Journal of the records not yet written in the segment files
+	msgIDBytes          = 16
+)
+
+// Prefixes of the journal records (2 bits followed by the sequence id)
+const (
+	journalPubPersistent = iota
+	journalPubTransient
+	journalDeliver
+	journalAck
+)
+
+// onlyUnacked is the index of the acknowledgements used to skip the acked messages (set by --only-unacked)
+var onlyUnacked *ackIndex
+
+// indexEntry is the state of a sequence id of a queue index
+type indexEntry struct {
+	id    string
+	marks int // Deliver and ack records, the segment files do not distinguish them (the second one is the ack)
+	acked bool
+}
+
+// ackIndex records the messages published in the queue indexes and whether they have been acknowledged
+// A message routed to several queues is only acked if it has been acked by all of them.
+type ackIndex struct {
+	pending map[string]bool // Message ids found in the indexes, true if still pending in at least one queue
+	queues  int
+	acked   int64 // Messages skipped because they have been acked
+	unknown int64 // Messages not found in the indexes (kept)
+}
+
+// loadAckIndex reads the segment files (and journal) of each queue index folder
+func loadAckIndex(files []string) (*ackIndex, error) {
+	folders := make(map[string][]string)
+	var order []string
+	for _, file := range files {
+		folder := filepath.Dir(file)
+		if folders[folder] == nil {
+			order = append(order, folder)
+		}
+		folders[folder] = append(folders[folder], file)
+	}
+
+	index := &ackIndex{pending: make(map[string]bool), queues: len(order)}
+	for _, folder := range order {
+		entries := make(map[int64]*indexEntry)
+		var journal []string
+		for _, file := range folders[folder] {
+			if filepath.Base(trimCompressionExt(file)) == indexJournalFile {
+				// The journal contains the most recent records, it is applied once all segments are read
+				journal = append(journal, file)
+				continue
+			}
+			segment, ok := segmentNumber(file)
+			if !ok {
+				continue
+			}
+			if err := readIndexFile(file, func(data []byte) error { return readIndexSegment(data, int64(segment), entries) }); err != nil {
+				return nil, err
+			}
+		}
+		for _, file := range journal {
+			if err := readIndexFile(file, func(data []byte) error { return readIndexJournal(data, entries) }); err != nil {
+				return nil, err
+			}
+		}
+		for _, entry := range entries {
+			if entry.id != "" {
+				index.pending[entry.id] = index.pending[entry.id] || !entry.acked
+			}
+		}
+	}
+	return index, nil
+}
+
+// readIndexFile reads (and decompresses) an index file before parsing it
+func readIndexFile(file string, parse func([]byte) error) error {
+	data, err := source.ReadFile(file)
+	if err == nil {
+		data, err = decompressData(file, data)
+	}
+	if err == nil {
+		err = parse(data)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read the queue index %s: %v", file, err)
+	}
+	return nil
+}
+
+// readIndexSegment parses the records of a segment file
+// Publish records start with bit 1 followed by the persistence bit and the relative sequence (14 bits), deliver and
+// ack records with bits 00 followed by the relative sequence.
+func readIndexSegment(data []byte, segment int64, entries map[int64]*indexEntry) error {
+	for pos := 0; pos+2 <= len(data); {
+		prefix := binary.BigEndian.Uint16(data[pos:])
+		seq := segment*indexSegmentEntries + int64(prefix&0x3fff)
+		switch {
+		case prefix&0x8000 != 0:
+			id, next, err := readIndexPublish(data, pos+2)
+			if err != nil {
+				return err
+			}
+			entries[seq] = &indexEntry{id: id}
+			pos = next
+		case prefix&0xc000 == 0:
+			if entry := entries[seq]; entry != nil {
+				entry.marks++
+				entry.acked = entry.marks >= 2
+			}
+			pos += 2
+		default:
+			return fmt.Errorf("Unknown record prefix %04X at %d", prefix, pos)
+		}
+	}
+	return nil
+}
+
+// readIndexJournal applies the records of a journal, each record starts with a 2 bits prefix and a 62 bits sequence id
+func readIndexJournal(data []byte, entries map[int64]*indexEntry) error {
+	for pos := 0; pos+8 <= len(data); {
+		word := binary.BigEndian.Uint64(data[pos:])
+		seq := int64(word & (1<<62 - 1))
+		pos += 8
+		switch word >> 62 {
+		case journalPubPersistent, journalPubTransient:
+			id, next, err := readIndexPublish(data, pos)
+			if err != nil {
+				return err
+			}
+			entries[seq] = &indexEntry{id: id}
+			pos = next
+		case journalDeliver:
+			if entry := entries[seq]; entry != nil {
+				entry.marks++
+			}
+		case journalAck:
+			if entry := entries[seq]; entry != nil {
+				entry.acked = true
+			}
+		}
+	}
+	return nil
+}
+
+// readIndexPublish returns the message id of the publish record body at pos and the position following the record
+// The body is followed by the size of the embedded message (small messages are stored in the index).
+func readIndexPublish(data []byte, pos int) (string, int, error) {
+	if pos+indexPubBodyBytes+4 > len(data) {
+		return "", 0, fmt.Errorf("Truncated publish record at %d", pos)
+	}
+	id := string(data[pos : pos+msgIDBytes])
+	next := pos + indexPubBodyBytes + 4 + int(binary.BigEndian.Uint32(data[pos+indexPubBodyBytes:]))
+	if next > len(data) {
+		return "", 0, fmt.Errorf("Truncated embedded message at %d", pos)
+	}
+	return id, next, nil
+}
+
+// Acked determines if the message has been acknowledged by all the queues where it has been published
+// Messages without id or not found in the indexes are considered as pending.
+func (index *ackIndex) Acked(msg *RabbitMessage) bool {
+	pending, found := index.pending[msg.StoreID]
+	switch {
+	case msg.StoreID == "" || !found:
+		atomic.AddInt64(&index.unknown, 1)
+		return false
+	case !pending:
+		atomic.AddInt64(&index.acked, 1)
+		return true
+	}
+	return false
+}
+
+// Describe summarizes the content of the indexes
+func (index *ackIndex) Describe() string {
+	var pending int
+	for _, p := range index.pending {
+		if p {
+			pending++
+		}
+	}
+	return fmt.Sprintf("%d message(s) in the index of %d queue(s), %d pending and %d acked", len(index.pending), index.queues, pending, len(index.pending)-pending)
+}
+
+// Report prints the number of messages skipped because they have been acked (nothing is done if the index is nil)
+func (index *ackIndex) Report() {
+	if index == nil {
+		return
+	}
+	errPrintln(color.GreenString("%d acked message(s) skipped by --only-unacked", atomic.LoadInt64(&index.acked)))
+	if unknown := atomic.LoadInt64(&index.unknown); unknown > 0 {
+		errPrintln(color.YellowString("%d message(s) not found in the queue indexes have been kept", unknown))
+	}
+}
@@ -4,23 +4,46 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/coveooss/multilogger/errors"
 	"github.com/fatih/color"
 )
 
 const (
-	rabbitHeaderBytes = "rabbit_framing_amqp_0_9_1"
-	lenHeader         = len(rabbitHeaderBytes)
+	maxPaddingBytes = 16
+	maxRecordTail   = 64 // End of the list of blocks followed by the message id and flags of a record
+	unknownQueue    = "<unknown>"
+	unknownBucket   = "__unknown__" // Name of the output file of the messages without queue
 )
 
+// framingHeader is the marker preceding the list of blocks of each message (set by --framing-header)
+var framingHeader = []byte("rabbit_framing_amqp_0_9_1")
+
+// maxMessageSize is the size above which a message is considered as a false positive (set by --max-message-size)
+var maxMessageSize int
+
+// failOnUnknown stops the processing of a file when a message has no destination
+var failOnUnknown bool
+
+// strictEOF reports the bytes left unparsed at the end of a file
+var strictEOF bool
+
+// terminatorBytes contains the bytes accepted after each message of a persistent store file
+var terminatorBytes = []byte{0xff}
+
 // RabbitBlob is a structure representing the data of a rabbit Index or persistent store file
 type RabbitBlob struct {
-	data   []byte
-	pos    int
-	name   string
-	no     int
-	useLen bool
+	data      []byte
+	pos       int
+	name      string
+	no        int
+	useLen    bool
+	storeV2   bool          // Classic queue v2 store file, the entries have their own header (see readStoreV2Entry)
+	carryOver bool          // A truncated message at the end of the blob is retained in pending instead of failing
+	base      int           // Position in the file of the data searched by parseMessage (records of a streamed file)
+	pending   *segmentCarry // Message started in the previous segment or continuing in the next one
+	corrupted Statistic     // Messages skipped by --skip-corrupt (size is the number of bytes skipped)
 }
 
 // Name returns the name of the current blob
@@ -28,80 +51,301 @@ func (rb *RabbitBlob) Name() string { return fmt.Sprintf("%s:%d", rb.name, rb.no
 
 // ProcessMessages scan a blob to extract all messages
 func (rb *RabbitBlob) ProcessMessages(handler func(*RabbitMessage)) {
+	rb.ProcessMessagesWhile(func(msg *RabbitMessage) bool {
+		if handler != nil {
+			handler(msg)
+		}
+		return true
+	})
+}
+
+// ProcessMessagesWhile scan a blob to extract messages until the handler returns false
+// If the data ends in the middle of a message, the error is reported and the scan stops, the messages found before are
+// kept.
+func (rb *RabbitBlob) ProcessMessagesWhile(handler func(*RabbitMessage) bool) {
+	current := rb.pos
 	defer func() {
-		if err := errors.Trap(nil, recover()); err != nil {
+		rec := recover()
+		if truncated, ok := rec.(truncatedData); ok {
+			rb.pos = len(rb.data)
+			parseFailed(rb.name, fmt.Errorf("Message at %d is truncated, the rest of the file is ignored: %v", current, truncated))
+			return
+		}
+		if err := errors.Trap(nil, rec); err != nil {
 			errors.Raise("Error %v while processing %s", err, rb.name)
 		}
 	}()
 
+	if rb.pending != nil && !rb.completePending(handler) {
+		return
+	}
 	for rb.pos < len(rb.data) {
-		msg := RabbitMessage{Position: rb.pos}
-		var blob *RabbitBlob
-		if rb.useLen {
-			msg.Length = int(rb.ReadUInt64())
-			blob = &RabbitBlob{
-				data: rb.ReadBytes(msg.Length),
-				name: rb.name,
+		current = rb.pos
+		msg := RabbitMessage{Position: rb.pos, File: rb.name}
+		found, skipped := rb.nextMessage(&msg)
+		if skipped {
+			continue
+		}
+		if !found {
+			break
+		}
+		if !handler(&msg) {
+			return
+		}
+	}
+	if strictEOF {
+		rb.checkEOF()
+	}
+}
+
+// nextMessage parses the message at the current position, it returns false if no message is found
+// With --skip-corrupt, a message whose structure is invalid is reported and skipped (skipped is true).
+func (rb *RabbitBlob) nextMessage(msg *RabbitMessage) (found, skipped bool) {
+	if skipCorrupt {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if !rb.skipCorrupted(msg, rec) {
+					panic(rec)
+				}
+				found, skipped = false, true
 			}
-			func() {
-				defer func() {
-					if err := recover(); err != nil {
-						errPrintln(color.RedString("Oh no! %v", err))
-					}
-				}()
-				rb.AssertByte(0xff)
-			}()
-		} else {
-			blob = rb
-		}
-		msgPos := bytes.Index(blob.data[blob.pos:], []byte(rabbitHeaderBytes))
+		}()
+	}
+
+	var blob *RabbitBlob
+	if rb.storeV2 {
+		if blob = rb.readStoreV2Entry(msg); blob == nil {
+			return false, false
+		}
+	} else if rb.useLen {
+		msg.Length = int(rb.ReadUInt64())
+		if rb.carryOver && rb.pos+msg.Length > len(rb.data) {
+			// The message continues in the next segment
+			rb.pending = &segmentCarry{file: rb.name, position: msg.Position, length: msg.Length, data: append([]byte{}, rb.data[rb.pos:]...)}
+			rb.pos = len(rb.data)
+			return false, false
+		}
+		blob = &RabbitBlob{
+			data: rb.ReadBytes(msg.Length),
+			name: rb.name,
+		}
+		msg.end = rb.pos
+		rb.skipTerminator()
+	} else {
+		blob = rb
+	}
+	if blob.parseMessage(msg, rb.data, rb.useLen || rb.storeV2) {
+		return true, false
+	}
+	// The markers of a record may all have been ignored, the following records are still processed
+	return false, blob != rb && bytes.Contains(blob.data, framingHeader)
+}
+
+// checkEOF reports the bytes that have not been consumed as messages, trailing zeros and terminators are tolerated
+// In index files, the end of the last record (following its body) is also tolerated.
+func (rb *RabbitBlob) checkEOF() {
+	leftover := bytes.TrimRight(rb.data[rb.pos:], string(append([]byte{0}, terminatorBytes...)))
+	if !rb.useLen && len(leftover) <= maxRecordTail && len(leftover) > 0 && leftover[0] == 'j' {
+		return
+	}
+	if len(leftover) > 0 {
+		errPrintln(color.YellowString("%d bytes left unparsed at %d in %s\n%s", len(leftover), rb.pos, rb.name, hexContext(rb.data, rb.pos+explainContext)))
+	}
+}
+
+// segmentCarry retains the beginning of a message that continues in the next segment file
+type segmentCarry struct {
+	file     string
+	position int
+	length   int
+	data     []byte
+}
+
+// warnIncomplete reports a message that has not been completed by the next segment
+func (carry *segmentCarry) warnIncomplete() {
+	if carry != nil {
+		errPrintln(color.YellowString("Message at %d in %s is truncated (%d of %d bytes) and has not been completed by the next segment", carry.position, carry.file, len(carry.data), carry.length))
+	}
+}
+
+// completePending reconstructs the message started in the previous segment with the beginning of the current one
+// It returns false if the handler requested to stop the processing.
+func (rb *RabbitBlob) completePending(handler func(*RabbitMessage) bool) bool {
+	carry := rb.pending
+	rb.pending = nil
+	need := carry.length - len(carry.data)
+	if need > len(rb.data) {
+		// The whole segment is part of the message
+		carry.data = append(carry.data, rb.data...)
+		rb.pos = len(rb.data)
+		rb.pending = carry
+		return true
+	}
+	carry.data = append(carry.data, rb.ReadBytes(need)...)
+	rb.skipTerminator()
+
+	// The destination is searched in the reconstructed message, so the position is only restored once parsed
+	msg := RabbitMessage{Length: carry.length, File: carry.file}
+	if (&RabbitBlob{data: carry.data, name: rb.name}).parseMessage(&msg, carry.data, true) {
+		errPrintln(color.GreenString("Message at %d in %s reconstructed with the beginning of %s", carry.position, carry.file, rb.name))
+		// The message spans two files, its end is unknown in the original one
+		msg.Position, msg.end = carry.position, 0
+		return handler(&msg)
+	}
+	return true
+}
+
+// skipTerminator skips the terminator following a message, reporting without failing if it is invalid
+func (rb *RabbitBlob) skipTerminator() {
+	defer func() {
+		if err := recover(); err != nil {
+			errPrintln(color.RedString("Oh no! %v", err))
+		}
+	}()
+	rb.SkipTerminator()
+}
+
+// parseMessage extracts the content of the message starting at the current position of the blob
+// origin is the data where the method is searched from the message position.
+// It returns false if no message is found.
+func (blob *RabbitBlob) parseMessage(msg *RabbitMessage, origin []byte, multiBlocks bool) bool {
+	start := blob.pos
+	for {
+		msgPos := bytes.Index(blob.data[blob.pos:], framingHeader)
 		if msgPos == -1 {
+			return false
+		}
+		blob.pos += msgPos
+		reason, tooLarge := blob.checkBlocks(blob.pos + len(framingHeader))
+		if reason == "" || !tooLarge && bytes.Index(blob.data[blob.pos+1:], framingHeader) < 0 {
+			// Without any following marker, the message is reported as truncated
 			break
 		}
-		blob.pos += msgPos + lenHeader
+		errPrintln(color.YellowString("Marker at offset %d of the message at %d in %s ignored, %s", blob.pos-start, blob.base+msg.Position, blob.name, reason))
+		blob.pos++
+	}
+	// The destination is stored before the framing marker, we do not search the following messages
+	header := blob.data[start:blob.pos]
+	msg.Properties, _ = blob.ReadProperties(blob.pos)
+	blob.pos += len(framingHeader)
 
-		blob.AssertByte('l')
-		nbBlocks := int(blob.ReadUInt32())
-		switch nbBlocks {
-		case 1:
+	blob.AssertByte('l')
+	nbBlocks := int(blob.ReadUInt32())
+	// Each block is at least a binary header ('m' + uint32 length), the marker has been kept because no other one
+	// follows so a larger count means that the data has been cut
+	blob.need(nbBlocks * 5)
+	switch nbBlocks {
+	case 1:
+		blob.AssertByte('m')
+		msg.Length = int(blob.ReadUInt32())
+		msg.Data = blob.ReadBytes(msg.Length)
+	default:
+		if !multiBlocks {
+			panic(corruptData{fmt.Errorf("Expected only one blob when reading from an index file.")})
+		}
+		msg.Data = make([]byte, 0, msg.Length)
+		blocks := make([][]byte, nbBlocks)
+		for i := range blocks {
 			blob.AssertByte('m')
-			msg.Length = int(blob.ReadUInt32())
-			msg.Data = blob.ReadBytes(msg.Length)
-		default:
-			if !rb.useLen {
-				errors.Raise("Expected only one blob when reading from an index file.")
-			}
-			msg.Data = make([]byte, 0, msg.Length)
-			blocks := make([][]byte, nbBlocks)
-			for i := range blocks {
-				blob.AssertByte('m')
-				blobLen := int(blob.ReadUInt32())
-				blocks[i] = blob.ReadBytes(blobLen)
-			}
-			// We have to join blocks in reverse order
-			for i := range blocks {
-				msg.Data = append(msg.Data, blocks[nbBlocks-i-1]...)
-			}
+			blobLen := int(blob.ReadUInt32())
+			blocks[i] = blob.ReadBytes(blobLen)
+		}
+		// We have to join blocks in reverse order
+		for i := range blocks {
+			msg.Data = append(msg.Data, blocks[nbBlocks-i-1]...)
 		}
+	}
 
-		msg.Queue = must(msg.GetQueueName(rb.data)).(string)
-		msg.Method = msg.GetMethod(rb.data)
+	msg.StoreID = blob.peekStoreID()
+	if msg.end == 0 {
+		msg.end = blob.pos
+	}
 
-		if handler != nil {
-			handler(&msg)
+	var err error
+	if msg.Queue, msg.RoutingKey, msg.Destination, err = findDestination(header); err != nil {
+		if failOnUnknown {
+			errors.Raise("Unable to find queuename at position %d in %s: %v", blob.base+msg.Position, blob.name, err)
 		}
+		// A single message without destination should not prevent the processing of the other messages
+		errPrintln(color.YellowString("Unable to find queuename at position %d in %s (%v), the message is assigned to %s\n%s", blob.base+msg.Position, blob.name, err, unknownQueue, hexContext(origin, msg.Position)))
+		msg.Queue, msg.Destination = unknownQueue, DestinationUnknown
+	}
+	msg.Method = msg.GetMethod(origin)
+	if inspectCMF {
+		msg.CMF = msg.GetCMF(origin)
+	}
+	return true
+}
+
+// checkBlocks validates the lengths of the list of blocks following a framing marker, so a marker found by
+// coincidence in a binary payload is not taken for a message. An empty reason is returned if the lengths are
+// plausible (the tags are checked when the blocks are read), tooLarge is set if --max-message-size is exceeded.
+func (blob *RabbitBlob) checkBlocks(pos int) (reason string, tooLarge bool) {
+	data := blob.data
+	if pos+5 > len(data) || data[pos] != 'l' {
+		return "", false
+	}
+	count := int(binary.BigEndian.Uint32(data[pos+1:]))
+	if count > (len(data)-pos-5)/5 {
+		return fmt.Sprintf("%d blocks cannot fit in the %d remaining bytes", count, len(data)-pos-5), false
+	}
+	total := 0
+	for i, at := 0, pos+5; i < count && at+5 <= len(data) && data[at] == 'm'; i++ {
+		length := int(binary.BigEndian.Uint32(data[at+1:]))
+		if at += 5; length > len(data)-at {
+			return fmt.Sprintf("block of %d bytes but only %d remain", length, len(data)-at), false
+		}
+		if total += length; maxMessageSize > 0 && total > maxMessageSize {
+			return fmt.Sprintf("message larger than --max-message-size (%d bytes)", maxMessageSize), true
+		}
+		at += length
+	}
+	return "", false
+}
+
+// peekStoreID returns the message id following the list of blocks (empty if not found), the position is unchanged
+func (rb *RabbitBlob) peekStoreID() string {
+	pos := rb.pos
+	if pos+6+msgIDBytes <= len(rb.data) && rb.data[pos] == 'j' && rb.data[pos+1] == 'm' && binary.BigEndian.Uint32(rb.data[pos+2:]) == msgIDBytes {
+		return string(rb.data[pos+6 : pos+6+msgIDBytes])
 	}
+	return ""
 }
 
-// ReadUInt32 extract an uint32 from the current file
+// truncatedData is raised when a read goes past the end of the data of a blob (i.e. the file has been cut)
+type truncatedData struct {
+	name      string
+	pos       int
+	n         int
+	available int
+}
+
+func (err truncatedData) Error() string {
+	return fmt.Sprintf("Unable to read %d bytes at %d in %s, only %d available", err.n, err.pos, err.name, err.available)
+}
+
+// corruptData is raised when the structure of a message does not match the expected layout
+type corruptData struct{ error }
+
+// need raises a truncatedData error if less than n bytes remain after the current position, so reads never go past
+// the data. The position is left unchanged on error.
+func (rb *RabbitBlob) need(n int) {
+	if n < 0 || n > len(rb.data)-rb.pos {
+		panic(truncatedData{rb.name, rb.pos, n, len(rb.data) - rb.pos})
+	}
+}
+
+// ReadUInt32 extract an uint32 (erlang binary and list lengths) from the current file
 func (rb *RabbitBlob) ReadUInt32() (result uint32) {
-	result = binary.BigEndian.Uint32(rb.data[rb.pos : rb.pos+8])
+	rb.need(4)
+	result = binary.BigEndian.Uint32(rb.data[rb.pos : rb.pos+4])
 	rb.pos += 4
 	return
 }
 
-// ReadUInt64 extract an uint64 from the current file
+// ReadUInt64 extract an uint64 (message store record lengths) from the current file
 func (rb *RabbitBlob) ReadUInt64() (result uint64) {
+	rb.need(8)
 	result = binary.BigEndian.Uint64(rb.data[rb.pos : rb.pos+8])
 	rb.pos += 8
 	return
@@ -109,11 +353,60 @@ func (rb *RabbitBlob) ReadUInt64() (result uint64) {
 
 // ReadBytes extract an array of bytes from the current file
 func (rb *RabbitBlob) ReadBytes(len int) (result []byte) {
+	rb.need(len)
 	result = rb.data[rb.pos : rb.pos+len]
 	rb.pos += len
 	return
 }
 
+// SkipTerminator skips the terminator following a message of a persistent store file
+// Padding bytes after the terminator are tolerated as long as a valid message length is found within maxPaddingBytes.
+func (rb *RabbitBlob) SkipTerminator() {
+	start := rb.pos
+	if start >= len(rb.data) {
+		return
+	}
+	if bytes.IndexByte(terminatorBytes, rb.data[start]) < 0 {
+		rb.AssertByte(terminatorBytes[0])
+	}
+	for padding := 1; padding <= maxPaddingBytes+1 && start+padding <= len(rb.data); padding++ {
+		if !rb.isMessageStart(start + padding) {
+			continue
+		}
+		if padding > 1 || rb.data[start] != 0xff {
+			errPrintln(color.YellowString("Unexpected padding % X after message at %d in %s", rb.data[start:start+padding], start, rb.name))
+		}
+		rb.pos = start + padding
+		return
+	}
+	if len(bytes.Trim(rb.data[start+1:], "\x00")) == 0 {
+		// The remaining of the file is only filled with zeros
+		rb.pos = len(rb.data)
+		return
+	}
+	errors.Raise("No message found within %d bytes after the terminator at %d in %s", maxPaddingBytes, start, rb.name)
+}
+
+// isMessageStart determines if a valid message length prefix starts at pos (or if pos is the end of the data)
+func (rb *RabbitBlob) isMessageStart(pos int) bool {
+	if pos == len(rb.data) {
+		return true
+	}
+	if pos+8 > len(rb.data) {
+		return false
+	}
+	length := binary.BigEndian.Uint64(rb.data[pos : pos+8])
+	if length == 0 {
+		return false
+	}
+	if length > uint64(len(rb.data)-pos-8) {
+		// The message continues in the next segment or the file has been cut, it is reported as truncated once read
+		return length <= math.MaxInt32
+	}
+	end := pos + 8 + int(length)
+	return end == len(rb.data) || bytes.IndexByte(terminatorBytes, rb.data[end]) >= 0
+}
+
 // AssertByte extract a byte from the current file
 func (rb *RabbitBlob) AssertByte(mustBe byte) {
 	if rb.ReadBytes(1)[0] != mustBe {
@@ -121,6 +414,6 @@ func (rb *RabbitBlob) AssertByte(mustBe byte) {
 		format := "%[1]X('%[1]c')"
 		expected := fmt.Sprintf(format, mustBe)
 		got := fmt.Sprintf(format, rb.data[rb.pos])
-		errors.Raise("Expected %s but got %s at %d in %s", expected, got, rb.pos, rb.name)
+		panic(corruptData{fmt.Errorf("Expected %s but got %s at %d in %s", expected, got, rb.pos, rb.name)})
 	}
 }
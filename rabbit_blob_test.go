@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// erlBinary encodes data as an erlang binary ('m' + uint32 length)
+func erlBinary(data []byte) []byte {
+	return append(append([]byte{'m'}, uint32Bytes(len(data))...), data...)
+}
+
+// erlAtom encodes an erlang atom ('d' + uint16 length)
+func erlAtom(name string) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(name)))
+	return append(append([]byte{'d'}, length...), name...)
+}
+
+func uint32Bytes(value int) []byte {
+	result := make([]byte, 4)
+	binary.BigEndian.PutUint32(result, uint32(value))
+	return result
+}
+
+// testMessage builds the term of a message published to exchange with routingKey as stored by RabbitMQ, the blocks
+// are given in their stored order (the body is made of the blocks in reverse order)
+func testMessage(exchange, routingKey string, blocks ...string) []byte {
+	var term bytes.Buffer
+	term.Write(erlAtom("basic_message"))
+	term.Write(erlAtom("resource"))
+	term.Write(erlBinary([]byte("/")))
+	term.Write(erlAtom("exchange"))
+	term.Write(erlBinary([]byte(exchange)))
+	term.WriteByte('l')
+	term.Write(uint32Bytes(1))
+	term.Write(erlBinary([]byte(routingKey)))
+	term.WriteByte('j')
+	term.Write(erlAtom("content"))
+	term.Write(erlBinary([]byte{0x10, 0x00, 2})) // delivery-mode 2
+	term.Write(erlAtom(string(framingHeader)))
+	term.WriteByte('l')
+	term.Write(uint32Bytes(len(blocks)))
+	for _, block := range blocks {
+		term.Write(erlBinary([]byte(block)))
+	}
+	return term.Bytes()
+}
+
+// testRecord wraps a message in a persistent store record (length, message id, message and terminator)
+func testRecord(message []byte) []byte {
+	content := append([]byte("0123456789abcdef"), message...)
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(content)))
+	return append(append(length, content...), 0xff)
+}
+
+// expectTruncated fails the test unless f raises a truncatedData error
+func expectTruncated(t *testing.T, f func()) {
+	t.Helper()
+	defer func() {
+		if _, ok := recover().(truncatedData); !ok {
+			t.Errorf("Expected a truncatedData error")
+		}
+	}()
+	f()
+}
+
+func TestReadUIntAtEndOfData(t *testing.T) {
+	blob := &RabbitBlob{data: []byte{0xff, 0xff, 0, 0, 0, 42}, pos: 2}
+	if got := blob.ReadUInt32(); got != 42 || blob.pos != 6 {
+		t.Errorf("ReadUInt32() = %d at %d, expected 42 at 6", got, blob.pos)
+	}
+	expectTruncated(t, func() { blob.ReadUInt32() })
+
+	blob = &RabbitBlob{data: []byte{0xff, 0, 0, 0, 0, 0, 0, 1, 7}, pos: 1}
+	if got := blob.ReadUInt64(); got != 263 || blob.pos != 9 {
+		t.Errorf("ReadUInt64() = %d at %d, expected 263 at 9", got, blob.pos)
+	}
+
+	blob = &RabbitBlob{data: []byte{0, 0, 0}}
+	expectTruncated(t, func() { blob.ReadUInt32() })
+	if blob.pos != 0 {
+		t.Errorf("The position changed to %d on a failed read", blob.pos)
+	}
+}
+
+// parseTestMessage parses the message at the start of data, rec is the error raised if any
+func parseTestMessage(data []byte, multiBlocks bool) (msg RabbitMessage, blob *RabbitBlob, found bool, rec interface{}) {
+	blob = &RabbitBlob{data: data, name: "test"}
+	defer func() { rec = recover() }()
+	found = blob.parseMessage(&msg, data, multiBlocks)
+	return
+}
+
+func TestParseMessageBlocks(t *testing.T) {
+	single := testMessage("", "q.one", "hello")
+	multi := testMessage("", "q.multi", "ghi", "def", "abc")
+	tests := []struct {
+		name        string
+		data        []byte
+		multiBlocks bool
+		wantData    string
+		wantQueue   string
+		wantError   interface{}
+	}{
+		{"1 block ending the data", single, false, "hello", "q.one", nil},
+		{"1 block of a record", single, true, "hello", "q.one", nil},
+		{"1 block missing its last byte", single[:len(single)-1], false, "", "", truncatedData{}},
+		{"1 block cut in its length", single[:len(single)-len("hello")-3], false, "", "", truncatedData{}},
+		{"N blocks ending the data", multi, true, "abcdefghi", "q.multi", nil},
+		{"N blocks missing the last byte", multi[:len(multi)-1], true, "", "", truncatedData{}},
+		{"N blocks cut in the block count", multi[:bytes.Index(multi, framingHeader)+len(framingHeader)+3], true, "", "", truncatedData{}},
+		{"N blocks in an index file", multi, false, "", "", corruptData{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, blob, found, rec := parseTestMessage(test.data, test.multiBlocks)
+			switch test.wantError.(type) {
+			case nil:
+				if rec != nil || !found {
+					t.Fatalf("parseMessage() failed: found=%v %v", found, rec)
+				}
+				if string(msg.Data) != test.wantData || msg.Queue != test.wantQueue {
+					t.Errorf("Got %q in %s, expected %q in %s", msg.Data, msg.Queue, test.wantData, test.wantQueue)
+				}
+				if blob.pos != len(test.data) {
+					t.Errorf("Position %d after the message, expected %d", blob.pos, len(test.data))
+				}
+			case truncatedData:
+				if _, ok := rec.(truncatedData); !ok {
+					t.Errorf("Expected truncatedData, got %v", rec)
+				}
+			case corruptData:
+				if _, ok := rec.(corruptData); !ok {
+					t.Errorf("Expected corruptData, got %v", rec)
+				}
+			}
+		})
+	}
+}
+
+func TestParseMessageBlockCount(t *testing.T) {
+	data := testMessage("", "q.one", "hello")
+	count := bytes.Index(data, framingHeader) + len(framingHeader) + 1
+	binary.BigEndian.PutUint32(data[count:], 1000)
+	if _, _, _, rec := parseTestMessage(data, true); rec == nil {
+		t.Errorf("A block count larger than the data should be rejected")
+	} else if _, ok := rec.(truncatedData); !ok {
+		t.Errorf("Expected truncatedData, got %v", rec)
+	}
+}
+
+func TestProcessTruncatedMessages(t *testing.T) {
+	first := testMessage("", "q.one", "first")
+	second := testMessage("", "q.two", "second")
+	index := append(append([]byte{}, first...), second...)
+	marker := len(first) + bytes.Index(second, framingHeader) + len(framingHeader)
+	records := append(testRecord(first), testRecord(second)...)
+	tests := []struct {
+		name   string
+		data   []byte
+		useLen bool
+	}{
+		{"Index cut in the 'l' asserted after the marker", index[:marker], false},
+		{"Index cut in the block count", index[:marker+3], false},
+		{"Index cut in the block length", index[:marker+5+2], false},
+		{"Index cut in the body", index[:len(index)-3], false},
+		{"Record cut in its message id", records[:len(testRecord(first))+8+5], true},
+		{"Record cut in its body", records[:len(records)-10], true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := parseErrors
+			blob := &RabbitBlob{data: test.data, name: "test", useLen: test.useLen}
+			var queues []string
+			blob.ProcessMessages(func(msg *RabbitMessage) { queues = append(queues, msg.Queue) })
+			if len(queues) != 1 || queues[0] != "q.one" {
+				t.Errorf("Got the messages of %v, expected only q.one", queues)
+			}
+			if blob.pos != len(test.data) {
+				t.Errorf("Position %d after the scan, expected %d", blob.pos, len(test.data))
+			}
+			if parseErrors != errors+1 {
+				t.Errorf("The truncated message has not been reported")
+			}
+		})
+	}
+}
+
+func TestFalseFramingMarkers(t *testing.T) {
+	// A marker followed by an implausible list of blocks, as it could appear in a binary payload
+	fake := append(append([]byte{}, framingHeader...), 'l', 0xff, 0xff, 0xff, 0xff)
+	body := "before" + string(fake) + "after"
+	tests := []struct {
+		name      string
+		data      []byte
+		useLen    bool
+		wantData  []string
+		maxLength int
+	}{
+		{"Marker before the message", append(append([]byte{}, fake...), testMessage("", "q.one", "hello")...), false, []string{"hello"}, 0},
+		{"Marker in the body of an index message", testMessage("", "q.one", body), false, []string{body}, 0},
+		{"Marker in the body of a record", append(testRecord(testMessage("", "q.one", body)), testRecord(testMessage("", "q.two", "next"))...), true, []string{body, "next"}, 0},
+		{"Record larger than --max-message-size", append(testRecord(testMessage("", "q.one", "too large")), testRecord(testMessage("", "q.two", "next"))...), true, []string{"next"}, 5},
+	}
+	defer func(size int) { maxMessageSize = size }(maxMessageSize)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxMessageSize = test.maxLength
+			blob := &RabbitBlob{data: test.data, name: "test", useLen: test.useLen}
+			var bodies []string
+			blob.ProcessMessages(func(msg *RabbitMessage) { bodies = append(bodies, string(msg.Data)) })
+			if fmt.Sprint(bodies) != fmt.Sprint(test.wantData) {
+				t.Errorf("Got %q, expected %q", bodies, test.wantData)
+			}
+		})
+	}
+}
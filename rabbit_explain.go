@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/coveooss/multilogger/errors"
+	"github.com/fatih/color"
+)
+
+const explainContext = 16
+
+// Explain walks the message starting at position and prints each parse step with the surrounding bytes
+func (rb *RabbitBlob) Explain(position int) (err error) {
+	step := func(format string, args ...interface{}) {
+		println(color.GreenString(format, args...))
+	}
+	defer func() {
+		if err = errors.Trap(err, recover()); err != nil {
+			errPrintln(color.RedString("Failed at %d: %v", rb.pos, err))
+			errPrintln(hexContext(rb.data, rb.pos))
+		}
+	}()
+
+	if position < 0 || position >= len(rb.data) {
+		return fmt.Errorf("Position %d is outside of %s (%d bytes)", position, rb.name, len(rb.data))
+	}
+	rb.pos = position
+	msg := RabbitMessage{Position: rb.pos}
+	blob := rb
+	if rb.useLen {
+		msg.Length = int(rb.ReadUInt64())
+		step("Store record length %d read at %d", msg.Length, position)
+		blob = &RabbitBlob{data: rb.ReadBytes(msg.Length), name: rb.name}
+		msg.end = rb.pos
+		step("Record terminator at %d", rb.pos)
+		println(hexContext(rb.data, rb.pos))
+		rb.AssertByte(0xff)
+		step("Following positions are relative to the record starting at %d", position+8)
+	}
+
+	msgPos := bytes.Index(blob.data[blob.pos:], framingHeader)
+	if msgPos == -1 {
+		return fmt.Errorf("Marker %s not found after %d", framingHeader, position)
+	}
+	blob.pos += msgPos
+	step("Marker %s found at %d (%d bytes after start)", framingHeader, blob.pos, msgPos)
+	println(hexContext(blob.data, blob.pos))
+	if props, err := blob.ReadProperties(blob.pos); err == nil {
+		msg.Properties = props
+		step("Properties found before the marker")
+	} else {
+		step("%v", err)
+	}
+	blob.pos += len(framingHeader)
+
+	blob.AssertByte('l')
+	nbBlocks := int(blob.ReadUInt32())
+	step("List of %d block(s) at %d", nbBlocks, blob.pos-5)
+	for i := 0; i < nbBlocks; i++ {
+		println(hexContext(blob.data, blob.pos))
+		blob.AssertByte('m')
+		blockLen := int(blob.ReadUInt32())
+		step("Block %d of %d bytes at %d", i+1, blockLen, blob.pos-5)
+		// Blocks are stored in reverse order
+		msg.Data = append(append([]byte{}, blob.ReadBytes(blockLen)...), msg.Data...)
+	}
+	if msg.end == 0 {
+		msg.end = blob.pos
+	}
+
+	queue, err := msg.GetQueueName(rb.data)
+	if err != nil {
+		return err
+	}
+	step("Queue name %s", queue)
+	msg.Queue, msg.File = queue, rb.name
+	msg.Method = msg.GetMethod(rb.data)
+	step("Method %s", msg.Method)
+	if inspectCMF {
+		msg.CMF = msg.GetCMF(rb.data)
+	}
+	step("Message of %d bytes ends at %d", len(msg.Data), rb.pos)
+	println(msg.PrettyPrint())
+	return nil
+}
+
+// hexContext returns an hexadecimal dump of the bytes surrounding the position
+func hexContext(data []byte, pos int) string {
+	start, end := pos-explainContext, pos+explainContext
+	if start < 0 {
+		start = 0
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+	if start >= end {
+		return fmt.Sprintf("<no data at %d>", pos)
+	}
+	return fmt.Sprintf("Bytes %d to %d:\n%s", start, end, hex.Dump(data[start:end]))
+}
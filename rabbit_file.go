@@ -2,14 +2,50 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 
 	"github.com/coveooss/multilogger/errors"
+	"github.com/fatih/color"
 )
 
+// Window of each file that is parsed (set by --start-offset and --max-bytes), the positions stay relative to the file
+var (
+	startOffset int64
+	maxBytes    int64 // 0 means up to the end of the file
+)
+
+// maxParseErrors is the number of files that may fail before the run is aborted (set by --max-parse-errors, 0 means no limit)
+// Below the limit, the errors raised while parsing a file are reported and the following files are processed.
+var maxParseErrors int32
+
+// parseErrors is the number of files that could not be read or parsed
+var parseErrors int32
+
+// parseFailed reports a file that could not be read or parsed, the run is aborted once maxParseErrors files failed
+func parseFailed(file string, err error) {
+	errPrintln(color.RedString(err.Error()))
+	runErrors.Add(errorParse, err, file, "", -1)
+	if count := atomic.AddInt32(&parseErrors, 1); maxParseErrors > 0 && count >= maxParseErrors {
+		errPrintln(color.RedString("Aborting after %d file(s) that could not be parsed, the files may not be RabbitMQ index or persistent store files (check --folder and --pattern)", count))
+		os.Exit(1)
+	}
+}
+
+// parseWindow returns the data up to the end of the window and the position where the parsing starts
+func parseWindow(data []byte) ([]byte, int) {
+	if startOffset >= int64(len(data)) {
+		return data, len(data)
+	}
+	if maxBytes > 0 && startOffset+maxBytes < int64(len(data)) {
+		data = data[:startOffset+maxBytes]
+	}
+	return data, int(startOffset)
+}
+
 // ReadRabbitFile load a RabbitMQ index or persistent store file in RAM
 func ReadRabbitFile(fileName string, reMatch *regexp.Regexp) (result RabbitFile, err error) {
 	defer func() {
@@ -17,15 +53,23 @@ func ReadRabbitFile(fileName string, reMatch *regexp.Regexp) (result RabbitFile,
 			err = fmt.Errorf("Error %v while processing %s", err, fileName)
 		}
 	}()
-	data, err := ioutil.ReadFile(fileName)
+	data, err := source.ReadFile(fileName)
+	if err == nil {
+		data, err = decompressData(fileName, data)
+	}
+	storeV2 := isStoreV2(data)
+	data, start := parseWindow(data)
 	return RabbitFile{
 		blob: RabbitBlob{
-			data:   data,
-			name:   fileName,
-			useLen: strings.HasSuffix(fileName, ".rdq"),
+			data:    data,
+			pos:     start,
+			name:    fileName,
+			useLen:  !storeV2 && strings.HasSuffix(trimCompressionExt(fileName), ".rdq"),
+			storeV2: storeV2,
 		},
 		match: reMatch,
 		Stat:  Statistic{Name: fileName},
+		Empty: err == nil && len(data)-start < len(framingHeader),
 	}, err
 }
 
@@ -36,6 +80,8 @@ type RabbitFile struct {
 	Stat     Statistic
 	Queues   Statistics
 	match    *regexp.Regexp
+	stream   *blobStream // Set if the file is parsed message by message (--streaming)
+	Empty    bool        // The file is too small to contain any message
 }
 
 // Name returns the name of the current file
@@ -45,24 +91,77 @@ func (rf *RabbitFile) Name() string { return rf.blob.name }
 func (rf *RabbitFile) Type() string { return strings.TrimPrefix(filepath.Ext(rf.Name()), ".") }
 
 // Count returns the number of messages in the file
-func (rf *RabbitFile) Count() int { return len(rf.Messages) }
+func (rf *RabbitFile) Count() int { return rf.Stat.Messages() }
 
 // Size returns the total size of messages in the file
 func (rf *RabbitFile) Size() float64 { return rf.Stat.Sum() }
 
+// JoinSegment enables the reconstruction of messages spanning several segments, previous is the pending message of the
+// previous segment (ignored if it is not a persistent store file of the same folder)
+func (rf *RabbitFile) JoinSegment(previous *segmentCarry) {
+	if !rf.blob.useLen {
+		previous.warnIncomplete()
+		return
+	}
+	rf.blob.carryOver = true
+	if previous != nil && filepath.Dir(previous.file) == filepath.Dir(rf.Name()) {
+		rf.blob.pending = previous
+	} else {
+		previous.warnIncomplete()
+	}
+}
+
+// Corrupted returns the statistic of the messages skipped by --skip-corrupt
+func (rf *RabbitFile) Corrupted() Statistic {
+	if rf.stream != nil {
+		return rf.stream.corrupted
+	}
+	return rf.blob.corrupted
+}
+
+// Pending returns the message that continues in the next segment if any
+func (rf *RabbitFile) Pending() *segmentCarry { return rf.blob.pending }
+
+// scan extracts the messages of the file (loaded or streamed) until the handler returns false
+func (rf *RabbitFile) scan(handler func(*RabbitMessage) bool) {
+	if rf.stream != nil {
+		rf.stream.ProcessMessagesWhile(handler)
+		return
+	}
+	rf.blob.ProcessMessagesWhile(handler)
+}
+
 // ProcessMessages scan a file to extract all messages
+// The messages of a streamed file are only retained in Messages if there is no handler, so the memory used is bounded
+// by the largest message.
 func (rf *RabbitFile) ProcessMessages(handler func(*RabbitMessage)) {
-	rf.blob.ProcessMessages(func(msg *RabbitMessage) {
+	if rf.Empty && rf.blob.pending == nil {
+		return
+	}
+	if maxParseErrors > 0 {
+		defer func() {
+			if err := errors.Trap(nil, recover()); err != nil {
+				parseFailed(rf.Name(), err)
+			}
+		}()
+	}
+	rf.scan(func(msg *RabbitMessage) bool {
 		if rf.match != nil {
 			if !rf.match.MatchString(msg.Queue) {
-				return
+				return true
 			}
 		}
-		rf.Messages = append(rf.Messages, msg)
+		if onlyUnacked != nil && onlyUnacked.Acked(msg) {
+			return true
+		}
+		if rf.stream == nil || handler == nil {
+			rf.Messages = append(rf.Messages, msg)
+		}
 		rf.Stat.Add(msg.Length)
 		rf.Queues.Add(msg.Queue, msg.Length)
 		if handler != nil {
 			handler(msg)
 		}
+		return true
 	})
 }
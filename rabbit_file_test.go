@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSmallFiles(t *testing.T) {
+	folder := t.TempDir()
+	tests := []struct {
+		name      string
+		data      []byte
+		wantEmpty bool
+		wantCount int
+	}{
+		{"0.idx", nil, true, 0},
+		{"1.rdq", nil, true, 0},
+		{"2.idx", []byte{0xff, 0, 0}, true, 0},
+		{"3.rdq", []byte{0, 0, 1}, true, 0},
+		{"4.rdq", testRecord(testMessage("", "q.one", "hello")), false, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(folder, test.name)
+			if err := ioutil.WriteFile(fileName, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := ReadRabbitFile(fileName, nil)
+			if err != nil {
+				t.Fatalf("ReadRabbitFile() failed: %v", err)
+			}
+			if file.Empty != test.wantEmpty {
+				t.Errorf("Empty = %v for %d bytes, expected %v", file.Empty, len(test.data), test.wantEmpty)
+			}
+			file.ProcessMessages(nil)
+			if file.Count() != test.wantCount {
+				t.Errorf("Got %d messages, expected %d", file.Count(), test.wantCount)
+			}
+		})
+	}
+}
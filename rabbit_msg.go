@@ -2,38 +2,168 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/coveooss/multilogger/errors"
 )
 
 const (
 	defaultMethod = "Process"
 )
 
+// Markers searched to find the destination and the method of a message (set by --queue-marker and --method-marker)
+var (
+	queueMarker  = []byte("exchange")
+	methodMarker = []byte("method:")
+)
+
+// inspectCMF enables the decoding of the PushAPI header of the push messages (set by --inspect-cmf)
+var inspectCMF bool
+
+// maxCMFLength is the maximum size of the PushAPI header searched around the method marker
+const maxCMFLength = 4096
+
+// Body encodings that can be detected on message data
+const (
+	encodingNone = "none"
+	encodingGzip = "gzip"
+	encodingZlib = "zlib"
+)
+
+// Destination indicates if a message was originally published to an exchange or directly to a queue
+type Destination int
+
+// Possible destinations of a message
+const (
+	DestinationUnknown Destination = iota
+	DestinationQueue
+	DestinationExchange
+)
+
 // RabbitMessage represents a message that must be stored into RabbitMQ
 type RabbitMessage struct {
 	Queue            string
 	Method           string
+	RoutingKey       string // Routing key used to publish the message originally
+	File             string // File where the message has been found
 	Data             []byte
 	Length, Position int
+	end              int // Offset following the message in the data where it has been found (0 if unknown)
+	Properties       *MessageProperties
+	Destination      Destination
+	CMF              map[string]string // Fields of the PushAPI header stored with the message (only set with --inspect-cmf)
+	StoreID          string            // Id of the message in the store, used to find its state in the queue indexes
 }
 
-// IsPush determines if the current messsage comes from PushAPI (Coveo related)
-func (msg *RabbitMessage) IsPush() bool { return msg.Data[0] != 'i' }
+// IsPush determines if the current messsage comes from PushAPI (Coveo related), an empty message is not
+func (msg *RabbitMessage) IsPush() bool { return len(msg.Data) > 0 && msg.Data[0] != 'i' }
+
+// ContentType returns the content-type property of the message if any
+func (msg *RabbitMessage) ContentType() string {
+	if msg.Properties == nil {
+		return ""
+	}
+	return msg.Properties.ContentType
+}
+
+// Priority returns the priority property of the message, 0 if unknown
+func (msg *RabbitMessage) Priority() uint8 {
+	if msg.Properties == nil {
+		return 0
+	}
+	return msg.Properties.Priority
+}
+
+// MessageID returns the message-id property of the message if any
+func (msg *RabbitMessage) MessageID() string {
+	if msg.Properties == nil {
+		return ""
+	}
+	return msg.Properties.MessageID
+}
+
+// ReplayID returns the message-id used to publish the message, so a message published twice could be recognized
+// The original message-id is kept, if there is none the id is derived from the location of the message.
+func (msg *RabbitMessage) ReplayID() string {
+	if id := msg.MessageID(); id != "" {
+		return id
+	}
+	if msg.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", msg.File, msg.Position)
+}
+
+// ExchangeRoutingKey returns the routing key used to republish the message to an exchange, so the message reaches the
+// same bindings as originally (the name of the exchange or queue if the original routing key has not been found)
+func (msg *RabbitMessage) ExchangeRoutingKey() string {
+	if msg.RoutingKey != "" {
+		return msg.RoutingKey
+	}
+	return msg.Queue
+}
+
+// Hash returns the SHA-256 of the message body
+func (msg *RabbitMessage) Hash() string {
+	sum := sha256.Sum256(msg.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// extent returns the bytes of the message within data, so the markers of the following messages are never used
+// The whole remaining data is returned if the end of the message is unknown.
+func (msg *RabbitMessage) extent(data []byte) []byte {
+	end := msg.end
+	if end <= msg.Position || end > len(data) {
+		end = len(data)
+	}
+	return data[msg.Position:end]
+}
 
 // GetQueueName retrieve the name of the queue that should be used
 func (msg *RabbitMessage) GetQueueName(data []byte) (string, error) {
-	blob := RabbitBlob{data: data[msg.Position:]}
-	if blob.pos = bytes.Index(blob.data, []byte("exchange")); blob.pos >= 0 {
-		blob.pos += 9
-		len := blob.ReadUInt32()
-		if len == 0 {
-			blob.pos += 6
-			len = blob.ReadUInt32()
-		}
+	name, _, err := msg.GetDestination(data)
+	return name, err
+}
 
-		return string(blob.ReadBytes(int(len))), nil
+// GetDestination retrieve the name of the exchange or queue that should be used and the kind of destination
+// Messages published to the default exchange are identified by an empty exchange name followed by the routing key.
+func (msg *RabbitMessage) GetDestination(data []byte) (string, Destination, error) {
+	name, _, destination, err := findDestination(msg.extent(data))
+	if err != nil {
+		return "", DestinationUnknown, fmt.Errorf("Unable to find queuename at position %d: %v", msg.Position, err)
 	}
-	return "", fmt.Errorf("Unable to find queuename at position %d", msg.Position)
+	return name, destination, nil
+}
+
+// findDestination retrieve the first destination found in data with the routing key, truncated data is reported as an error
+// The exchange name is followed by the list of routing keys, only the first one is returned.
+func findDestination(data []byte) (name, routingKey string, destination Destination, err error) {
+	defer func() { err = errors.Trap(err, recover()) }()
+	blob := RabbitBlob{data: data}
+	if blob.pos = bytes.Index(blob.data, queueMarker); blob.pos < 0 {
+		return "", "", DestinationUnknown, fmt.Errorf("no %s marker found", queueMarker)
+	}
+	// The marker is followed by the binary type of the name
+	blob.pos += len(queueMarker) + 1
+	length := blob.ReadUInt32()
+	if length == 0 {
+		blob.pos += 6
+		name = string(blob.ReadBytes(int(blob.ReadUInt32())))
+		return name, name, DestinationQueue, nil
+	}
+	name = string(blob.ReadBytes(int(length)))
+	if blob.pos+6 <= len(blob.data) && blob.data[blob.pos] == 'l' && blob.data[blob.pos+5] == 'm' {
+		blob.pos += 6
+		routingKey = string(blob.ReadBytes(int(blob.ReadUInt32())))
+	}
+	return name, routingKey, DestinationExchange, nil
 }
 
 // GetMethod retrieve the method that should be used, defaults to "Process"
@@ -42,12 +172,84 @@ func (msg *RabbitMessage) GetMethod(data []byte) string {
 		return defaultMethod
 	}
 
-	blob := RabbitBlob{data: data[msg.Position:]}
-	if blob.pos = bytes.Index(blob.data, []byte("method:")); blob.pos >= 0 {
-		blob.pos += 7
+	blob := RabbitBlob{data: msg.extent(data)}
+	if blob.pos = bytes.Index(blob.data, methodMarker); blob.pos >= 0 {
+		blob.pos += len(methodMarker)
 		if len := bytes.Index(blob.data[blob.pos:], []byte(",")); len != -1 {
 			return string(blob.ReadBytes(len))
 		}
 	}
 	return defaultMethod
 }
+
+// GetCMF retrieve the fields of the PushAPI header ({url:...,method:...,zip:...}) stored with a push message
+// The header is delimited by the braces surrounding the method marker, nil is returned if there is no such header.
+func (msg *RabbitMessage) GetCMF(data []byte) map[string]string {
+	if !msg.IsPush() {
+		return nil
+	}
+
+	extent := msg.extent(data)
+	marker := bytes.Index(extent, methodMarker)
+	if marker < 0 {
+		return nil
+	}
+	start := bytes.LastIndexByte(extent[:marker], '{')
+	end := bytes.IndexByte(extent[marker:], '}')
+	if start < 0 || end < 0 || marker+end-start > maxCMFLength || bytes.IndexByte(extent[start:marker], '}') >= 0 {
+		return nil
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(string(extent[start+1:marker+end]), ",") {
+		if parts := strings.SplitN(field, ":", 2); len(parts) == 2 {
+			fields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return fields
+}
+
+// Encoding detects if the message body is compressed by looking at its magic bytes
+func (msg *RabbitMessage) Encoding() string {
+	data := msg.Data
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		return encodingGzip
+	case len(data) >= 2 && data[0]&0x0f == 8 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		return encodingZlib
+	}
+	return encodingNone
+}
+
+// Decompress returns the uncompressed body of the message, limited to max bytes if max > 0
+// The stored body is left untouched.
+func (msg *RabbitMessage) Decompress(max int) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch msg.Encoding() {
+	case encodingGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(msg.Data))
+	case encodingZlib:
+		reader, err = zlib.NewReader(bytes.NewReader(msg.Data))
+	default:
+		reader = bytes.NewReader(msg.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 {
+		reader = io.LimitReader(reader, int64(max))
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// CompressionRatio returns the ratio between the uncompressed and the stored size of the body
+func (msg *RabbitMessage) CompressionRatio() (float64, error) {
+	if len(msg.Data) == 0 || msg.Encoding() == encodingNone {
+		return 1, nil
+	}
+	data, err := msg.Decompress(0)
+	if err != nil {
+		return 0, err
+	}
+	return float64(len(data)) / float64(len(msg.Data)), nil
+}
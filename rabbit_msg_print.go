@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// previewLength is the number of body bytes included in the rendering of a message
+const previewLength = 32
+
+// String summarizes the message on a single line
+func (msg *RabbitMessage) String() string {
+	return fmt.Sprintf("queue=%s size=%d position=%d push=%t method=%s body=%s",
+		msg.Queue, len(msg.Data), msg.Position, msg.IsPush(), msg.Method, msg.preview())
+}
+
+// PrettyPrint renders the message with its decoded properties and headers on several lines
+func (msg *RabbitMessage) PrettyPrint() string {
+	var lines []string
+	add := func(name string, format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf("%-17s %s", name+":", fmt.Sprintf(format, args...)))
+	}
+
+	switch msg.Destination {
+	case DestinationExchange:
+		add("Exchange", "%s (routing key %q)", msg.Queue, msg.RoutingKey)
+	default:
+		add("Queue", "%s", msg.Queue)
+	}
+	if msg.File != "" {
+		add("Location", "%s at %d", msg.File, msg.Position)
+	} else {
+		add("Position", "%d", msg.Position)
+	}
+	add("Size", "%d bytes (%s)", len(msg.Data), msg.Encoding())
+	if msg.IsPush() {
+		add("PushAPI", "method %s", msg.Method)
+	}
+
+	if props := msg.Properties; props != nil {
+		for _, field := range []struct{ name, value string }{
+			{"Content type", props.ContentType},
+			{"Content encoding", props.ContentEncoding},
+			{"Correlation id", props.CorrelationID},
+			{"Reply to", props.ReplyTo},
+			{"Expiration", props.Expiration},
+			{"Message id", props.MessageID},
+			{"Type", props.Type},
+			{"User id", props.UserID},
+			{"App id", props.AppID},
+			{"Cluster id", props.ClusterID},
+		} {
+			if field.value != "" {
+				add(field.name, "%s", field.value)
+			}
+		}
+		if props.DeliveryMode != 0 {
+			add("Delivery mode", "%d", props.DeliveryMode)
+		}
+		if props.Priority != 0 {
+			add("Priority", "%d", props.Priority)
+		}
+		if !props.Timestamp.IsZero() {
+			add("Timestamp", "%s", props.Timestamp.UTC().Format(time.RFC3339))
+		}
+		names := make([]string, 0, len(props.Headers))
+		for name := range props.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add("Header", "%s=%v", name, props.Headers[name])
+		}
+	}
+	if msg.CMF != nil {
+		add("CMF", "%s", formatCMF(msg.CMF))
+	}
+	add("Body", "%s", msg.preview())
+	return strings.Join(lines, "\n")
+}
+
+// formatCMF renders the fields of a PushAPI header sorted by name
+func formatCMF(fields map[string]string) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + fields[name]
+	}
+	return strings.Join(names, " ")
+}
+
+// preview returns the beginning of the decompressed body quoted (the raw body if it cannot be decompressed)
+func (msg *RabbitMessage) preview() string {
+	head, err := msg.Decompress(previewLength + 1)
+	if err != nil || len(head) == 0 {
+		head = msg.Data
+	}
+	suffix := ""
+	if len(head) > previewLength {
+		head, suffix = head[:previewLength], "..."
+	}
+	return fmt.Sprintf("%q%s", head, suffix)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestEmptyMessage(t *testing.T) {
+	data := testMessage("", "q.empty", "")
+	blob := &RabbitBlob{data: data, name: "test"}
+	var messages []*RabbitMessage
+	blob.ProcessMessages(func(msg *RabbitMessage) { messages = append(messages, msg) })
+	if len(messages) != 1 {
+		t.Fatalf("Got %d messages, expected 1", len(messages))
+	}
+	msg := messages[0]
+	if len(msg.Data) != 0 || msg.Queue != "q.empty" {
+		t.Errorf("Got %q in %s, expected an empty message in q.empty", msg.Data, msg.Queue)
+	}
+	if msg.IsPush() {
+		t.Errorf("An empty message should not be a push message")
+	}
+	if method := msg.GetMethod(data); method != defaultMethod {
+		t.Errorf("GetMethod() = %s, expected %s", method, defaultMethod)
+	}
+	if record := newDumpRecord("test", msg, true, bodyBase64); record.Size != 0 || record.Push {
+		t.Errorf("Unexpected dump record %+v", record)
+	}
+}
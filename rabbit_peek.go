@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/coveooss/multilogger/errors"
+)
+
+// Peek prints the metadata of the first count messages of the file, stopping the parse once they are found
+// If preview is greater than zero, a hex/ascii dump of the first preview bytes of each body is also printed.
+func (rf *RabbitFile) Peek(count, preview int) (err error) {
+	defer func() { err = errors.Trap(err, recover()) }()
+
+	found := 0
+	rf.scan(func(msg *RabbitMessage) bool {
+		found++
+		fmt.Printf("#%d %s\n", found, msg)
+		if inspectCMF {
+			if msg.CMF != nil {
+				fmt.Printf("   cmf: %s\n", formatCMF(msg.CMF))
+			} else if msg.IsPush() {
+				fmt.Println("   cmf: not found")
+			}
+		}
+		if preview > 0 {
+			head := msg.Data
+			if len(head) > preview {
+				head = head[:preview]
+			}
+			fmt.Print(hex.Dump(head))
+		}
+		return found < count
+	})
+	if found == 0 {
+		return fmt.Errorf("No message found in %s", rf.Name())
+	}
+	return nil
+}
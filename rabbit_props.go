@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/coveooss/multilogger/errors"
+	"github.com/streadway/amqp"
+)
+
+// maxPropertiesLength is the maximum size of the properties binary searched before the framing marker
+const maxPropertiesLength = 1 << 16
+
+// Flags of the AMQP 0-9-1 basic class content header
+const (
+	flagContentType     = 0x8000
+	flagContentEncoding = 0x4000
+	flagHeaders         = 0x2000
+	flagDeliveryMode    = 0x1000
+	flagPriority        = 0x0800
+	flagCorrelationID   = 0x0400
+	flagReplyTo         = 0x0200
+	flagExpiration      = 0x0100
+	flagMessageID       = 0x0080
+	flagTimestamp       = 0x0040
+	flagType            = 0x0020
+	flagUserID          = 0x0010
+	flagAppID           = 0x0008
+	flagClusterID       = 0x0004
+)
+
+// MessageProperties represents the AMQP basic properties stored with a message
+type MessageProperties struct {
+	ContentType     string
+	ContentEncoding string
+	Headers         amqp.Table
+	DeliveryMode    uint8
+	Priority        uint8
+	CorrelationID   string
+	ReplyTo         string
+	Expiration      string
+	MessageID       string
+	Timestamp       time.Time
+	Type            string
+	UserID          string
+	AppID           string
+	ClusterID       string
+}
+
+// Expired determines if the message expiration has elapsed since its timestamp
+// Messages without expiration or timestamp never expire.
+func (props *MessageProperties) Expired(now time.Time) bool {
+	if props == nil || props.Expiration == "" || props.Timestamp.IsZero() {
+		return false
+	}
+	ttl, err := strconv.ParseInt(props.Expiration, 10, 64)
+	if err != nil {
+		return false
+	}
+	return props.Timestamp.Add(time.Duration(ttl) * time.Millisecond).Before(now)
+}
+
+// ReadProperties extracts the properties binary stored just before the framing marker found at markerPos
+// The properties are stored as an erlang binary ('m' + uint32 length) followed by the protocol atom, so we
+// look backward for a binary whose length ends exactly where the atom starts.
+func (rb *RabbitBlob) ReadProperties(markerPos int) (*MessageProperties, error) {
+	end := markerPos
+	switch {
+	case end >= 3 && (rb.data[end-3] == 'd' || rb.data[end-3] == 'v'):
+		end -= 3
+	case end >= 2 && rb.data[end-2] == 'w':
+		end -= 2
+	default:
+		return nil, fmt.Errorf("No atom header found before position %d", markerPos)
+	}
+
+	for length := 2; length <= maxPropertiesLength && end-length-5 >= 0; length++ {
+		start := end - length
+		if rb.data[start-5] != 'm' || int(binary.BigEndian.Uint32(rb.data[start-4:start])) != length {
+			continue
+		}
+		if props, err := parseProperties(rb.data[start:end]); err == nil {
+			return props, nil
+		}
+	}
+	return nil, fmt.Errorf("No properties found before position %d", markerPos)
+}
+
+// parseProperties decodes an AMQP 0-9-1 basic content header property list
+func parseProperties(data []byte) (props *MessageProperties, err error) {
+	defer func() { err = errors.Trap(err, recover()) }()
+
+	r := &propertyReader{data: data}
+	flags := r.uint16()
+	if flags&0x0001 != 0 {
+		return nil, fmt.Errorf("Unsupported continuation of property flags")
+	}
+	props = &MessageProperties{}
+	if flags&flagContentType != 0 {
+		props.ContentType = r.shortString()
+	}
+	if flags&flagContentEncoding != 0 {
+		props.ContentEncoding = r.shortString()
+	}
+	if flags&flagHeaders != 0 {
+		props.Headers = r.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		props.DeliveryMode = r.byte()
+	}
+	if flags&flagPriority != 0 {
+		props.Priority = r.byte()
+	}
+	if flags&flagCorrelationID != 0 {
+		props.CorrelationID = r.shortString()
+	}
+	if flags&flagReplyTo != 0 {
+		props.ReplyTo = r.shortString()
+	}
+	if flags&flagExpiration != 0 {
+		props.Expiration = r.shortString()
+	}
+	if flags&flagMessageID != 0 {
+		props.MessageID = r.shortString()
+	}
+	if flags&flagTimestamp != 0 {
+		props.Timestamp = r.timestamp()
+	}
+	if flags&flagType != 0 {
+		props.Type = r.shortString()
+	}
+	if flags&flagUserID != 0 {
+		props.UserID = r.shortString()
+	}
+	if flags&flagAppID != 0 {
+		props.AppID = r.shortString()
+	}
+	if flags&flagClusterID != 0 {
+		props.ClusterID = r.shortString()
+	}
+	if r.pos != len(data) {
+		return nil, fmt.Errorf("%d unexpected bytes after properties", len(data)-r.pos)
+	}
+	return props, nil
+}
+
+// propertyReader reads AMQP encoded values, raising an error if the data is too short
+type propertyReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *propertyReader) bytes(n int) []byte {
+	if n < 0 || r.pos+n > len(r.data) {
+		errors.Raise("Unable to read %d bytes at %d, only %d available", n, r.pos, len(r.data)-r.pos)
+	}
+	r.pos += n
+	return r.data[r.pos-n : r.pos]
+}
+
+func (r *propertyReader) byte() byte           { return r.bytes(1)[0] }
+func (r *propertyReader) uint16() uint16       { return binary.BigEndian.Uint16(r.bytes(2)) }
+func (r *propertyReader) uint32() uint32       { return binary.BigEndian.Uint32(r.bytes(4)) }
+func (r *propertyReader) uint64() uint64       { return binary.BigEndian.Uint64(r.bytes(8)) }
+func (r *propertyReader) done() bool           { return r.pos >= len(r.data) }
+func (r *propertyReader) shortString() string  { return string(r.bytes(int(r.byte()))) }
+func (r *propertyReader) longBytes() []byte    { return r.bytes(int(r.uint32())) }
+func (r *propertyReader) timestamp() time.Time { return time.Unix(int64(r.uint64()), 0) }
+
+// table reads a field table, values are converted to the types supported by amqp.Table
+func (r *propertyReader) table() amqp.Table {
+	nested := &propertyReader{data: r.longBytes()}
+	table := make(amqp.Table)
+	for !nested.done() {
+		name := nested.shortString()
+		table[name] = nested.field()
+	}
+	return table
+}
+
+func (r *propertyReader) field() interface{} {
+	switch kind := r.byte(); kind {
+	case 't':
+		return r.byte() != 0
+	case 'b', 'B':
+		return r.byte()
+	case 's':
+		return int16(r.uint16())
+	case 'u':
+		return int32(r.uint16())
+	case 'I':
+		return int32(r.uint32())
+	case 'i':
+		return int64(r.uint32())
+	case 'l':
+		return int64(r.uint64())
+	case 'f':
+		return math.Float32frombits(r.uint32())
+	case 'd':
+		return math.Float64frombits(r.uint64())
+	case 'D':
+		return amqp.Decimal{Scale: r.byte(), Value: int32(r.uint32())}
+	case 'S':
+		return string(r.longBytes())
+	case 'A':
+		nested := &propertyReader{data: r.longBytes()}
+		var array []interface{}
+		for !nested.done() {
+			array = append(array, nested.field())
+		}
+		return array
+	case 'T':
+		return r.timestamp()
+	case 'F':
+		return r.table()
+	case 'x':
+		return append([]byte{}, r.longBytes()...)
+	case 'V':
+		return nil
+	default:
+		errors.Raise("Unknown field type %c at %d", kind, r.pos-1)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/coveooss/multilogger/errors"
+	"github.com/fatih/color"
+)
+
+// maxStreamPrealloc is the largest buffer allocated before reading a record whose length cannot be checked
+const maxStreamPrealloc = 1 << 20
+
+// streamFiles parses the persistent store files message by message instead of loading them whole (set by --streaming)
+var streamFiles bool
+
+// loadRabbitFile reads a RabbitMQ file whole or prepares it to be streamed according to --streaming
+func loadRabbitFile(fileName string, reMatch *regexp.Regexp) (RabbitFile, error) {
+	if streamFiles {
+		return ReadRabbitFileStreaming(fileName, reMatch)
+	}
+	return ReadRabbitFile(fileName, reMatch)
+}
+
+// ReadRabbitFileStreaming prepares a persistent store file to be parsed message by message, only the message being
+// parsed is held in memory. The file is opened when its messages are processed.
+// Index files and v2 store files (bounded by the number of entries of a segment) are loaded whole, the files of a
+// remote source are streamed as well.
+func ReadRabbitFileStreaming(fileName string, reMatch *regexp.Regexp) (RabbitFile, error) {
+	if storeVersion == storeVersion2 || !strings.HasSuffix(trimCompressionExt(fileName), ".rdq") {
+		return ReadRabbitFile(fileName, reMatch)
+	}
+	result := RabbitFile{
+		blob:   RabbitBlob{name: fileName, useLen: true},
+		stream: &blobStream{name: fileName},
+		match:  reMatch,
+		Stat:   Statistic{Name: fileName},
+	}
+	size, err := source.Size(fileName)
+	if err == nil && trimCompressionExt(fileName) == fileName {
+		window := size - startOffset
+		if maxBytes > 0 && maxBytes < window {
+			window = maxBytes
+		}
+		result.Empty = window < int64(len(framingHeader))
+	}
+	return result, err
+}
+
+// blobStream reads the records of a persistent store file one at a time
+// Each record is parsed on its own buffer, which also serves as the data searched for the destination and the method
+// of its message (these lookups never go past the end of the message).
+type blobStream struct {
+	name      string
+	reader    *bufio.Reader
+	pos       int   // Position in the (uncompressed) file
+	remaining int64 // Upper bound of the bytes left to read, -1 if unknown (compressed file without --max-bytes)
+	corrupted Statistic
+}
+
+// open opens the file from the source and skips the bytes before --start-offset
+func (s *blobStream) open() io.Closer {
+	file := must(source.Open(s.name)).(io.ReadCloser)
+	reader, compressed := decompressReader(s.name, file)
+	skipped, _ := reader.Discard(int(startOffset))
+	s.pos, s.remaining = skipped, -1
+	if !compressed {
+		s.remaining = must(source.Size(s.name)).(int64) - int64(skipped)
+	}
+	if maxBytes > 0 {
+		reader = bufio.NewReader(io.LimitReader(reader, maxBytes))
+		if s.remaining < 0 || maxBytes < s.remaining {
+			s.remaining = maxBytes
+		}
+	}
+	s.reader = reader
+	return file
+}
+
+// advance moves the position after n bytes read or skipped
+func (s *blobStream) advance(n int) {
+	s.pos += n
+	if s.remaining >= 0 {
+		s.remaining -= int64(n)
+	}
+}
+
+// ProcessMessagesWhile scan the file to extract messages until the handler returns false
+// Truncated messages are handled as in RabbitBlob.ProcessMessagesWhile.
+func (s *blobStream) ProcessMessagesWhile(handler func(*RabbitMessage) bool) {
+	current := int(startOffset)
+	defer func() {
+		rec := recover()
+		if truncated, ok := rec.(truncatedData); ok {
+			parseFailed(s.name, fmt.Errorf("Message at %d is truncated, the rest of the file is ignored: %v", current, truncated))
+			return
+		}
+		if err := errors.Trap(nil, rec); err != nil {
+			errors.Raise("Error %v while processing %s", err, s.name)
+		}
+	}()
+
+	defer s.open().Close()
+	for {
+		current = s.pos
+		record, ok := s.readRecord()
+		if !ok {
+			break
+		}
+		s.skipTerminator()
+
+		// The message is parsed relative to its record, the position in the file is set once parsed
+		msg := RabbitMessage{Length: len(record) - 8, File: s.name, end: len(record)}
+		blob := &RabbitBlob{data: record[8:], name: s.name, base: current}
+		found, skipped := s.parseRecord(blob, &msg, record)
+		if skipped {
+			continue
+		}
+		if !found {
+			break
+		}
+		msg.Position, msg.end = current, current+len(record)
+		if !handler(&msg) {
+			return
+		}
+	}
+	if strictEOF {
+		s.checkEOF()
+	}
+}
+
+// parseRecord parses the message of a record, with --skip-corrupt a corrupted message is reported and skipped
+// Only the messages whose record is intact can be skipped, the file cannot be searched for the next message.
+func (s *blobStream) parseRecord(blob *RabbitBlob, msg *RabbitMessage, record []byte) (found, skipped bool) {
+	if skipCorrupt {
+		defer func() {
+			if rec := recover(); rec != nil {
+				switch rec.(type) {
+				case corruptData, truncatedData:
+				default:
+					panic(rec)
+				}
+				s.corrupted.Add(len(record))
+				errPrintln(color.YellowString("Corrupted message at %d in %s skipped, resuming at %d: %v", blob.base, s.name, s.pos, rec))
+				found, skipped = false, true
+			}
+		}()
+	}
+	if blob.parseMessage(msg, record, true) {
+		return true, false
+	}
+	return false, bytes.Contains(blob.data, framingHeader)
+}
+
+// readRecord returns the next record with its length prefix, false is returned at the end of the file
+func (s *blobStream) readRecord() ([]byte, bool) {
+	var prefix [8]byte
+	read, err := io.ReadFull(s.reader, prefix[:])
+	if err == io.EOF {
+		return nil, false
+	}
+	if err == io.ErrUnexpectedEOF {
+		panic(truncatedData{s.name, s.pos, len(prefix), read})
+	}
+	must(err)
+	s.advance(len(prefix))
+
+	// The length is checked before reading, so a corrupted length never allocates more than the file
+	length := binary.BigEndian.Uint64(prefix[:])
+	if s.remaining >= 0 && length > uint64(s.remaining) {
+		panic(truncatedData{s.name, s.pos, int(length), int(s.remaining)})
+	}
+	if length > math.MaxInt32 {
+		errors.Raise("Invalid message length %d at %d in %s", length, s.pos, s.name)
+	}
+	capacity := int(length)
+	if s.remaining < 0 && capacity > maxStreamPrealloc {
+		// The length of a compressed file cannot be checked, the buffer grows as the record is read
+		capacity = maxStreamPrealloc
+	}
+	record := bytes.NewBuffer(make([]byte, 0, len(prefix)+capacity))
+	record.Write(prefix[:])
+	copied, err := io.CopyN(record, s.reader, int64(length))
+	s.advance(int(copied))
+	if err == io.EOF {
+		panic(truncatedData{s.name, s.pos - int(copied), int(length), int(copied)})
+	}
+	must(err)
+	return record.Bytes(), true
+}
+
+// skipTerminator skips the terminator following a message, reporting without failing if it is invalid
+// The padding is searched in the bytes following the terminator as in RabbitBlob.SkipTerminator, but the length found
+// cannot be checked against the end of the message since it has not been read yet.
+func (s *blobStream) skipTerminator() {
+	window, err := s.reader.Peek(1 + maxPaddingBytes + 8)
+	atEOF := err != nil
+	if len(window) == 0 {
+		return
+	}
+	start := s.pos
+	if bytes.IndexByte(terminatorBytes, window[0]) < 0 {
+		errPrintln(color.RedString("Oh no! Expected %X but got %X at %d in %s", terminatorBytes[0], window[0], start, s.name))
+		return
+	}
+	for padding := 1; padding <= maxPaddingBytes+1; padding++ {
+		if padding == len(window) && atEOF || padding+8 <= len(window) && isRecordLength(window[padding:]) {
+			if padding > 1 || window[0] != 0xff {
+				errPrintln(color.YellowString("Unexpected padding % X after message at %d in %s", window[:padding], start, s.name))
+			}
+			s.reader.Discard(padding)
+			s.advance(padding)
+			return
+		}
+	}
+	if atEOF && len(bytes.Trim(window[1:], "\x00")) == 0 {
+		// The remaining of the file is only filled with zeros
+		s.reader.Discard(len(window))
+		s.advance(len(window))
+		return
+	}
+	errPrintln(color.RedString("Oh no! No message found within %d bytes after the terminator at %d in %s", maxPaddingBytes, start, s.name))
+}
+
+// isRecordLength determines if data starts with a plausible message length
+func isRecordLength(data []byte) bool {
+	length := binary.BigEndian.Uint64(data)
+	return length != 0 && length <= math.MaxInt32
+}
+
+// checkEOF reports the bytes that have not been consumed as messages, trailing zeros and terminators are tolerated
+func (s *blobStream) checkEOF() {
+	start, leftover := s.pos, 0
+	for read := 1; ; read++ {
+		b, err := s.reader.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != 0 && bytes.IndexByte(terminatorBytes, b) < 0 {
+			leftover = read
+		}
+	}
+	if leftover > 0 {
+		errPrintln(color.YellowString("%d bytes left unparsed at %d in %s", leftover, start, s.name))
+	}
+}
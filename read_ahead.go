@@ -0,0 +1,53 @@
+package main
+
+// readAhead reads the files on background goroutines while the current one is processed, files are returned in order
+// At most width files are being read or waiting to be processed, so the memory used remains bounded.
+type readAhead struct {
+	results []chan readResult
+	tokens  chan bool
+	stop    chan bool
+	next    int
+}
+
+type readResult struct {
+	file RabbitFile
+	err  error
+}
+
+func newReadAhead(files []string, width int) *readAhead {
+	if width < 1 {
+		width = 1
+	}
+	r := &readAhead{results: make([]chan readResult, len(files)), tokens: make(chan bool, width), stop: make(chan bool)}
+	for i := range r.results {
+		r.results[i] = make(chan readResult, 1)
+	}
+	go func() {
+		for i, file := range files {
+			select {
+			case r.tokens <- true:
+			case <-r.stop:
+				return
+			}
+			i, file := i, file
+			go func() {
+				data, err := loadRabbitFile(file, nil)
+				r.results[i] <- readResult{data, err}
+			}()
+		}
+	}()
+	return r
+}
+
+// Next returns the next file of the list, it blocks until the file has been read
+func (r *readAhead) Next() (RabbitFile, error) {
+	result := <-r.results[r.next]
+	r.next++
+	<-r.tokens
+	return result.file, result.err
+}
+
+// Stop cancels the reading of the files that have not been started, it must be called if all files are not consumed
+func (r *readAhead) Stop() {
+	close(r.stop)
+}
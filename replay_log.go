@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const replayLogFlushInterval = time.Second
+
+// replayLogRecord represents a published message in the replay log (JSON lines)
+type replayLogRecord struct {
+	Time       time.Time `json:"time"`
+	Queue      string    `json:"queue"`
+	Exchange   string    `json:"exchange"`
+	RoutingKey string    `json:"routing_key"`
+	Hash       string    `json:"hash"`
+	MessageID  string    `json:"message_id,omitempty"`
+}
+
+// replayLog appends a record for each published message, it is shared by all publishers
+type replayLog struct {
+	sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	lastFlush time.Time
+}
+
+func newReplayLog(fileName string) *replayLog {
+	file := must(os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)).(*os.File)
+	return &replayLog{file: file, writer: bufio.NewWriter(file), lastFlush: time.Now()}
+}
+
+// Write adds a record to the log, the log is flushed periodically
+func (log *replayLog) Write(record replayLogRecord) {
+	log.Lock()
+	defer log.Unlock()
+	must(json.NewEncoder(log.writer).Encode(record))
+	if time.Since(log.lastFlush) > replayLogFlushInterval {
+		must(log.writer.Flush())
+		log.lastFlush = time.Now()
+	}
+}
+
+// Close flushes and closes the log
+func (log *replayLog) Close() {
+	log.Lock()
+	defer log.Unlock()
+	must(log.writer.Flush())
+	must(log.file.Close())
+}
+
+// replayLogIndex contains the messages that have already been replayed according to a replay log
+type replayLogIndex struct {
+	hashes     map[string]bool
+	messageIDs map[string]bool
+}
+
+func readReplayLog(fileName string) *replayLogIndex {
+	index := &replayLogIndex{hashes: make(map[string]bool), messageIDs: make(map[string]bool)}
+	file := must(os.Open(fileName)).(*os.File)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var record replayLogRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			errPrintf("Ignoring invalid line %d in %s: %v\n", line, fileName, err)
+			continue
+		}
+		index.hashes[record.Hash] = true
+		if record.MessageID != "" {
+			index.messageIDs[record.MessageID] = true
+		}
+	}
+	must(scanner.Err())
+	return index
+}
+
+// Contains determines if the message has already been replayed
+func (index *replayLogIndex) Contains(msg *RabbitMessage) bool {
+	if id := msg.MessageID(); id != "" && index.messageIDs[id] {
+		return true
+	}
+	return index.hashes[msg.Hash()]
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// Orders supported by --replay-order
+const (
+	replayByFiles    = "files"
+	replayByQueues   = "queues"
+	replayInterleave = "interleave"
+)
+
+// chunkPattern matches the numeric suffix added to the files written by split-messages --chunk-size
+var chunkPattern = regexp.MustCompile(`\.(\d{4,})$`)
+
+// chunkFileName returns the name of a chunk of the messages of a queue (numbered from 1)
+func chunkFileName(fileName string, chunk int) string { return fmt.Sprintf("%s.%04d", fileName, chunk) }
+
+// splitChunk returns the file name without its chunk suffix and the chunk number (0 if it is not a chunk)
+func splitChunk(fileName string) (string, int) {
+	fileName = trimCompressionExt(fileName)
+	if match := chunkPattern.FindStringSubmatch(fileName); match != nil {
+		chunk, _ := strconv.Atoi(match[1])
+		return strings.TrimSuffix(fileName, match[0]), chunk
+	}
+	return fileName, 0
+}
+
+// removeUnknownBucket excludes the files of the messages whose queue has not been found (unknownBucket and its chunks),
+// they would otherwise be published to a queue named after the bucket (and declared with --declare-queues)
+func removeUnknownBucket(files []string) []string {
+	result := files[:0]
+	for _, file := range files {
+		if name, _ := splitChunk(file); filepath.Base(name) == unknownBucket {
+			errPrintln(color.YellowString("Skipping %s, the messages without queue are only replayed with --replay-unknown", file))
+			continue
+		}
+		result = append(result, file)
+	}
+	return result
+}
+
+// replayFile is a file of extracted messages being replayed
+type replayFile struct {
+	name     string
+	file     *os.File
+	reader   *bufio.Reader
+	encoding string
+	offset   int64 // Offset following the last line read
+}
+
+func openReplayFile(fileName, encoding string, resume bool) *replayFile {
+	fmt.Println("Processing file", fileName)
+	file := must(os.Open(fileName)).(*os.File)
+	reader, compressed := openDecompressed(file)
+	result := &replayFile{name: fileName, file: file, reader: reader, encoding: encoding}
+	if resume {
+		result.offset = readProgress(fileName)
+	}
+	if result.offset > 0 && compressed {
+		// Compressed files cannot be seeked, the messages already replayed are read and skipped
+		must(io.CopyN(ioutil.Discard, reader, result.offset))
+	} else if result.offset > 0 {
+		// The start of the file has been buffered to detect its compression, a new reader starts at the offset
+		must(file.Seek(result.offset, io.SeekStart))
+		result.reader = bufio.NewReader(file)
+	}
+	if result.offset > 0 {
+		fmt.Println("Resuming at offset", result.offset)
+	}
+	return result
+}
+
+// Queue returns the name of the queue of the messages in the file
+func (f *replayFile) Queue() string {
+	name, _ := splitChunk(f.name)
+	return filepath.Base(name)
+}
+
+// Next returns the next line (or binary record) of the file, the file is closed once all lines have been read
+// Corrupted binary records are reported and skipped, the rest of the file is ignored if a record is truncated.
+func (f *replayFile) Next() (string, bool) {
+	for {
+		line, size, err := readRecord(f.reader, f.encoding)
+		if corrupt, ok := err.(corruptRecord); ok {
+			errPrintln(color.YellowString("%v at offset %d of %s, the record is skipped", corrupt, f.offset, f.name))
+			runErrors.Add(errorDecode, corrupt, f.name, f.Queue(), int(f.offset))
+			f.offset += int64(size)
+			if !corrupt.truncated {
+				continue
+			}
+			err = io.EOF
+		}
+		if err == io.EOF {
+			f.file.Close()
+			return "", false
+		}
+		must(err)
+		f.offset += int64(size)
+		return line, true
+	}
+}
+
+// replayQueue is the list of files containing the messages of a queue, chunks are read in turn
+type replayQueue struct {
+	name     string
+	files    []string
+	current  *replayFile
+	encoding string
+	resume   bool
+}
+
+// Next returns the next line of the queue and the file where it has been read
+func (q *replayQueue) Next() (*replayFile, string, bool) {
+	for {
+		if q.current == nil {
+			if len(q.files) == 0 {
+				return nil, "", false
+			}
+			q.current, q.files = openReplayFile(q.files[0], q.encoding, q.resume), q.files[1:]
+		}
+		if line, ok := q.current.Next(); ok {
+			return q.current, line, true
+		}
+		q.current = nil
+	}
+}
+
+// groupChunks groups the chunks of the same queue (in the order of their first file) and sorts them by number
+func groupChunks(files []string, encoding string, resume bool) []*replayQueue {
+	var result []*replayQueue
+	chunks := make(map[string]*replayQueue)
+	for _, fileName := range files {
+		name, _ := splitChunk(fileName)
+		queue := chunks[name]
+		if queue == nil {
+			queue = &replayQueue{name: filepath.Base(name), encoding: encoding, resume: resume}
+			chunks[name] = queue
+			result = append(result, queue)
+		}
+		queue.files = append(queue.files, fileName)
+	}
+	for _, queue := range result {
+		sort.SliceStable(queue.files, func(i, j int) bool {
+			_, ci := splitChunk(queue.files[i])
+			_, cj := splitChunk(queue.files[j])
+			return ci < cj
+		})
+	}
+	return result
+}
+
+// readReplayFiles calls send for each line of the files in the requested order until send returns false
+// With interleave, all the queues are read in turn, one message per queue. The chunks of a queue are always
+// read in the order of their number.
+func readReplayFiles(files []string, order, encoding string, resume bool, send func(*replayFile, string) bool) {
+	queues := groupChunks(files, encoding, resume)
+	switch order {
+	case replayByQueues:
+		sort.SliceStable(queues, func(i, j int) bool { return queues[i].name < queues[j].name })
+	case replayInterleave:
+		for active := queues; len(active) > 0; {
+			remaining := active[:0]
+			for _, queue := range active {
+				if file, line, ok := queue.Next(); ok {
+					if !send(file, line) {
+						return
+					}
+					remaining = append(remaining, queue)
+				}
+			}
+			active = remaining
+		}
+		return
+	}
+
+	for _, queue := range queues {
+		for file, line, ok := queue.Next(); ok; file, line, ok = queue.Next() {
+			if !send(file, line) {
+				return
+			}
+		}
+	}
+}
+
+// replayProgress records the offsets of the lines delivered (published or dead lettered) by the publisher
+// The progress of a file stops before its first message that has not been delivered, so a resumed replay starts with
+// it. Sent is called by the reader of the files and Done by the publisher, in the order of the messages.
+type replayProgress struct {
+	enabled   bool
+	lock      sync.Mutex
+	count     int
+	sent      map[*RabbitMessage]sentLine
+	confirmed map[*replayFile]int64
+	stopped   map[*replayFile]bool
+}
+
+// sentLine is the file of a message handed to the publisher and the offset following its line
+type sentLine struct {
+	file   *replayFile
+	offset int64
+}
+
+// Sent records the line of a message before it is handed to the publisher
+func (p *replayProgress) Sent(msg *RabbitMessage, file *replayFile) {
+	if !p.enabled {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.sent == nil {
+		p.sent = make(map[*RabbitMessage]sentLine)
+		p.confirmed = make(map[*replayFile]int64)
+		p.stopped = make(map[*replayFile]bool)
+	}
+	p.sent[msg] = sentLine{file, file.offset}
+}
+
+// Done records the outcome of a message, the lines of its file are confirmed up to it if it has been delivered
+func (p *replayProgress) Done(msg *RabbitMessage, delivered bool) {
+	if !p.enabled {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	line, ok := p.sent[msg]
+	if !ok {
+		return
+	}
+	delete(p.sent, msg)
+	if !delivered {
+		p.stopped[line.file] = true
+	}
+	if p.stopped[line.file] {
+		return
+	}
+	p.confirmed[line.file] = line.offset
+	if p.count++; p.count%progressInterval == 0 {
+		p.flush()
+	}
+}
+
+// Flush writes the confirmed offsets in the progress files
+func (p *replayProgress) Flush() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.flush()
+}
+
+func (p *replayProgress) flush() {
+	for file, offset := range p.confirmed {
+		writeProgress(file.name, offset)
+		delete(p.confirmed, file)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayResume(t *testing.T) {
+	folder := t.TempDir()
+	write := func(name string, count int) (string, []int64) {
+		var content strings.Builder
+		var offsets []int64
+		for i := 0; i < count; i++ {
+			content.WriteString(exportRecord(bodyBase64, []byte(fmt.Sprintf("%s %d", name, i))))
+			offsets = append(offsets, int64(content.Len()))
+		}
+		fileName := filepath.Join(folder, name)
+		if err := ioutil.WriteFile(fileName, []byte(content.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName, offsets
+	}
+	// A file smaller than the read buffer without progress, and a larger one resumed after its 600th message
+	small, _ := write("q.small", 2)
+	large, offsets := write("q.large", 1000)
+	writeProgress(large, offsets[599])
+
+	var bodies []string
+	readReplayFiles([]string{small, large}, replayByFiles, bodyBase64, true, func(file *replayFile, line string) bool {
+		data, err := decodeBody(bodyBase64, line)
+		if err != nil {
+			t.Fatalf("Unable to decode %q of %s: %v", line, file.name, err)
+		}
+		bodies = append(bodies, string(data))
+		return true
+	})
+	if len(bodies) != 402 || bodies[0] != "q.small 0" || bodies[1] != "q.small 1" || bodies[2] != "q.large 600" || bodies[401] != "q.large 999" {
+		t.Errorf("Got %d messages (%q...), expected both messages of q.small then q.large from 600", len(bodies), bodies[:3])
+	}
+}
+
+func TestReplayProgress(t *testing.T) {
+	folder := t.TempDir()
+	first := &replayFile{name: filepath.Join(folder, "q.one")}
+	second := &replayFile{name: filepath.Join(folder, "q.two")}
+	progress := &replayProgress{enabled: true}
+	var messages []*RabbitMessage
+	for i, file := range []*replayFile{first, first, first, second, second} {
+		file.offset = int64(10 * (i + 1))
+		msg := &RabbitMessage{Queue: filepath.Base(file.name)}
+		progress.Sent(msg, file)
+		messages = append(messages, msg)
+	}
+	// The second message of q.one has been neither published nor dead lettered, the third one must be replayed again
+	for i, delivered := range []bool{true, false, true, true, true} {
+		progress.Done(messages[i], delivered)
+	}
+	progress.Flush()
+	if offset := readProgress(first.name); offset != 10 {
+		t.Errorf("The progress of q.one is %d, expected 10 (the first message)", offset)
+	}
+	if offset := readProgress(second.name); offset != 50 {
+		t.Errorf("The progress of q.two is %d, expected 50 (the last message)", offset)
+	}
+}
+
+func TestRemoveUnknownBucket(t *testing.T) {
+	files := []string{"out/q.one", "out/" + unknownBucket, "out/" + unknownBucket + ".0002.zst", "out/q.two.0001", "out/" + unknownBucket + ".old"}
+	expected := []string{"out/q.one", "out/q.two.0001", "out/" + unknownBucket + ".old"}
+	if result := removeUnknownBucket(files); strings.Join(result, ",") != strings.Join(expected, ",") {
+		t.Errorf("removeUnknownBucket() = %v, expected %v", result, expected)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	progressExt      = ".progress"
+	progressInterval = 1000
+)
+
+// progressFile returns the name of the sidecar file used to record the replay progress of a file
+func progressFile(fileName string) string { return fileName + progressExt }
+
+// readProgress returns the offset recorded for a file, 0 if there is no progress recorded
+func readProgress(fileName string) int64 {
+	content, err := ioutil.ReadFile(progressFile(fileName))
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		errPrintf("Ignoring invalid progress file %s: %v\n", progressFile(fileName), err)
+		return 0
+	}
+	return offset
+}
+
+// writeProgress records the offset of the last line published for a file
+func writeProgress(fileName string, offset int64) {
+	must(ioutil.WriteFile(progressFile(fileName), []byte(strconv.FormatInt(offset, 10)), 0644))
+}
+
+// removeProgressFiles excludes the progress sidecars and the manifests from the list of files
+func removeProgressFiles(files []string) []string {
+	result := files[:0]
+	for _, file := range files {
+		if !strings.HasSuffix(file, progressExt) && filepath.Base(file) != manifestFile && filepath.Base(file) != checksumFile {
+			result = append(result, file)
+		}
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// Kinds of the errors collected during the run
+const (
+	errorParse    = "Parse"
+	errorPublish  = "Publish"
+	errorConflict = "Declare conflict"
+	errorDecode   = "Decode"
+	errorNack     = "Nack"
+	errorVerify   = "Verify"
+)
+
+// maxReportedErrors is the number of errors detailed in the final report, the others are only counted
+const maxReportedErrors = 50
+
+// runError is an error that did not stop the run with the context where it occurred
+type runError struct {
+	kind     string
+	file     string
+	queue    string
+	position int // -1 if unknown
+	err      error
+}
+
+// RunErrors collects the errors tolerated during the run, so they are reported together once the run is over
+// It is safe for concurrent use.
+type RunErrors struct {
+	lock   sync.Mutex
+	errors []runError
+	counts map[string]int
+}
+
+// runErrors aggregates the errors of the current run
+var runErrors = &RunErrors{counts: make(map[string]int)}
+
+// Add records an error, file and queue are optional and position is -1 if unknown
+// The error is still printed when it occurs, so its context stays visible in the log.
+func (r *RunErrors) Add(kind string, err error, file, queue string, position int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counts[kind]++
+	if len(r.errors) < maxReportedErrors {
+		r.errors = append(r.errors, runError{kind, file, queue, position, err})
+	}
+}
+
+// Count returns the number of errors collected
+func (r *RunErrors) Count() (total int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, count := range r.counts {
+		total += count
+	}
+	return total
+}
+
+// Report prints the table of the errors collected and the number of errors by kind
+// It returns false if there is no error.
+func (r *RunErrors) Report() bool {
+	total := r.Count()
+	if total == 0 {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	fmt.Println()
+	table := getTable("Kind", "File", "Queue", "Position", "Error")
+	table.SetAutoWrapText(false)
+	for _, e := range r.errors {
+		position := ""
+		if e.position >= 0 {
+			position = fmt.Sprint(e.position)
+		}
+		table.Append([]string{e.kind, e.file, e.queue, position, e.err.Error()})
+	}
+	table.Render()
+
+	kinds := make([]string, 0, len(r.counts))
+	for kind := range r.counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%s: %d", kind, r.counts[kind])
+	}
+	detail := ""
+	if total > len(r.errors) {
+		detail = fmt.Sprintf(", only the first %d are detailed", len(r.errors))
+	}
+	errPrintln(color.RedString("%d error(s) during the run (%s)%s", total, strings.Join(kinds, ", "), detail))
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3Scheme        = "s3://"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat   = "20060102T150405Z"
+	amzAlgorithm    = "AWS4-HMAC-SHA256"
+	defaultS3Region = "us-east-1"
+)
+
+// s3Source reads the files from an S3 bucket (or an S3 compatible storage if AWS_ENDPOINT_URL is set)
+// Credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, requests are
+// sent anonymously if no credentials are defined.
+type s3Source struct {
+	client    *http.Client
+	bucket    string
+	prefix    string // Folder of the bucket where the objects are listed, it ends with / unless empty
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	lock      sync.Mutex
+	sizes     map[string]int64 // Size of the objects returned by Find
+}
+
+func newS3Source(sourceURL string) (*s3Source, error) {
+	location := strings.TrimPrefix(sourceURL, s3Scheme)
+	parts := strings.SplitN(location, "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("No bucket specified in %s", sourceURL)
+	}
+	// The objects are parsed as they are downloaded, so only the wait for the response is bounded
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	source := &s3Source{
+		client:    &http.Client{Transport: transport},
+		bucket:    parts[0],
+		endpoint:  strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		// The prefix is a folder, s3://bucket/foo does not list the objects of foobar/
+		source.prefix = strings.TrimSuffix(parts[1], "/") + "/"
+	}
+	if source.region == "" {
+		source.region = defaultS3Region
+	}
+	return source, nil
+}
+
+// Find lists the objects under the prefix whose base name matches one of the patterns
+func (s *s3Source) Find(maxDepth int, patterns ...string) ([]string, error) {
+	if maxDepth <= 0 {
+		maxDepth = unlimitedDepth
+	}
+	var result []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		content, err := s.get("", query)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(content, &list); err != nil {
+			return nil, fmt.Errorf("Invalid list result for %s%s: %v", s3Scheme, s.bucket, err)
+		}
+		for _, object := range list.Contents {
+			rel := strings.TrimPrefix(strings.TrimPrefix(object.Key, s.prefix), "/")
+			if strings.HasSuffix(object.Key, "/") || strings.Count(rel, "/") >= maxDepth {
+				continue
+			}
+			for _, pattern := range patterns {
+				if match, _ := path.Match(pattern, path.Base(object.Key)); match {
+					result = append(result, s3Scheme+s.bucket+"/"+object.Key)
+					s.lock.Lock()
+					if s.sizes == nil {
+						s.sizes = make(map[string]int64)
+					}
+					s.sizes[object.Key] = object.Size
+					s.lock.Unlock()
+					break
+				}
+			}
+		}
+		if !list.IsTruncated {
+			return result, nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+// ReadFile downloads an object returned by Find
+func (s *s3Source) ReadFile(name string) ([]byte, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.get(key, nil)
+}
+
+// Open returns the content of an object returned by Find as it is downloaded
+func (s *s3Source) Open(name string) (io.ReadCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.send(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+// Size returns the size of an object, as listed by Find if it has been returned by Find
+func (s *s3Source) Size(name string) (int64, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	size, listed := s.sizes[key]
+	s.lock.Unlock()
+	if listed {
+		return size, nil
+	}
+	response, err := s.send(http.MethodHead, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return response.ContentLength, nil
+}
+
+// key returns the key of an object returned by Find
+func (s *s3Source) key(name string) (string, error) {
+	prefix := s3Scheme + s.bucket + "/"
+	if !strings.HasPrefix(name, prefix) {
+		return "", fmt.Errorf("%s is not in %s", name, prefix)
+	}
+	return strings.TrimPrefix(name, prefix), nil
+}
+
+// get downloads the key (or the bucket listing if key is empty)
+func (s *s3Source) get(key string, query url.Values) ([]byte, error) {
+	response, err := s.send(http.MethodGet, key, query)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return ioutil.ReadAll(response.Body)
+}
+
+// send sends a signed request for the key (or the bucket if key is empty), the body of the response must be closed
+func (s *s3Source) send(method, key string, query url.Values) (*http.Response, error) {
+	var host, uri string
+	if s.endpoint != "" {
+		endpoint, err := url.Parse(s.endpoint)
+		if err != nil {
+			return nil, err
+		}
+		host = endpoint.Host
+		uri = endpoint.Scheme + "://" + host + s3Escape("/"+s.bucket+"/"+key)
+	} else {
+		host = fmt.Sprintf("%s.s3.%s.amazonaws.com", s.bucket, s.region)
+		uri = "https://" + host + s3Escape("/"+key)
+	}
+	if len(query) > 0 {
+		uri += "?" + s3Query(query)
+	}
+	request, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(request, time.Now().UTC())
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		content, _ := ioutil.ReadAll(response.Body)
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, uri, response.Status, strings.TrimSpace(string(content)))
+	}
+	return response, nil
+}
+
+// sign adds the AWS signature version 4 authorization to the request
+func (s *s3Source) sign(request *http.Request, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+	date := now.Format(amzDateFormat)
+	request.Header.Set("X-Amz-Date", date)
+	request.Header.Set("X-Amz-Content-Sha256", emptyPayload)
+	if s.token != "" {
+		request.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayload,
+	}, "\n")
+	scope := strings.Join([]string{date[:8], s.region, "s3", "aws4_request"}, "/")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{amzAlgorithm, date, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, value := range []string{date[:8], s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, value)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", amzAlgorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// s3Escape encodes a path as expected by the AWS signature (only unreserved characters and / are kept)
+func s3Escape(value string) string {
+	var result strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', strings.IndexByte("-._~/", b) >= 0:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
+
+// s3Query encodes the query sorted by key as expected by the AWS signature
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, strings.Replace(s3Escape(key), "/", "%2F", -1)+"="+strings.Replace(s3Escape(value), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/fatih/color"
+)
+
+// skipCorrupt skips the messages whose structure is invalid instead of abandoning the rest of the file (set by
+// --skip-corrupt)
+var skipCorrupt bool
+
+// maxResyncDistance is the maximum distance between the start of a record and its framing marker searched to resume
+// the parsing after a corrupted message (the destination and the properties are stored before the marker)
+const maxResyncDistance = 64 << 10
+
+// skipCorrupted reports a corrupted message and moves to the following one, it returns false if the error is not
+// caused by a corrupted message or if no message can be found after it (a truncated file is reported as such)
+// If the record of the message has been read, the parsing resumes after it, otherwise the next framing marker is
+// searched and the record containing it is located.
+func (rb *RabbitBlob) skipCorrupted(msg *RabbitMessage, rec interface{}) bool {
+	var err error
+	switch e := rec.(type) {
+	case corruptData:
+		err = e
+	case truncatedData:
+		err = e
+	default:
+		return false
+	}
+
+	start := msg.Position
+	if !((rb.useLen || rb.storeV2) && msg.end > start) && !rb.resync(start) {
+		if _, truncated := rec.(truncatedData); truncated {
+			return false
+		}
+		rb.pos = len(rb.data)
+	}
+	rb.corrupted.Add(rb.pos - start)
+	errPrintln(color.YellowString("Corrupted message at %d in %s skipped, resuming at %d: %v", start, rb.name, rb.pos, err))
+	return true
+}
+
+// resync moves the position to the start of the first message found after start, false is returned if there is none
+func (rb *RabbitBlob) resync(start int) bool {
+	if !rb.useLen && !rb.storeV2 {
+		// The messages of an index file are found by searching their marker, the marker of the corrupted one is skipped
+		found := bytes.Index(rb.data[start:], framingHeader)
+		if found < 0 {
+			return false
+		}
+		rb.pos = start + found + 1
+		return true
+	}
+	for from := start + 1; from < len(rb.data); {
+		found := bytes.Index(rb.data[from:], framingHeader)
+		if found < 0 {
+			return false
+		}
+		marker := from + found
+		for pos := marker - 8; pos > start && pos >= marker-maxResyncDistance; pos-- {
+			if rb.isRecordStart(pos, marker) {
+				rb.pos = pos
+				return true
+			}
+		}
+		from = marker + 1
+	}
+	return false
+}
+
+// isRecordStart determines if a record containing the marker starts at pos and ends at a record boundary
+func (rb *RabbitBlob) isRecordStart(pos, marker int) bool {
+	if pos+8 > len(rb.data) {
+		return false
+	}
+	var end int
+	if rb.storeV2 {
+		end = pos + storeV2EntryBytes + int(binary.BigEndian.Uint32(rb.data[pos:]))
+	} else if length := binary.BigEndian.Uint64(rb.data[pos:]); length <= uint64(len(rb.data)-pos-8) {
+		end = pos + 8 + int(length)
+	}
+	if end <= marker || end > len(rb.data) {
+		return false
+	}
+	if end == len(rb.data) || rb.storeV2 {
+		return true
+	}
+	return bytes.IndexByte(terminatorBytes, rb.data[end]) >= 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// fileSource abstracts the storage where the RabbitMQ files are read
+type fileSource interface {
+	// Find returns the name of the files matching the patterns
+	Find(maxDepth int, patterns ...string) ([]string, error)
+	// ReadFile returns the whole content of a file returned by Find
+	ReadFile(name string) ([]byte, error)
+	// Open returns a reader of the content of a file returned by Find, so it can be parsed without being loaded whole
+	Open(name string) (io.ReadCloser, error)
+	// Size returns the size of a file returned by Find
+	Size(name string) (int64, error)
+}
+
+// source is the storage used to find and read the RabbitMQ files (local filesystem by default)
+var source fileSource = localSource{}
+
+// newSource returns the source corresponding to the url, an empty url means the local folders
+func newSource(url string, folders []string) (fileSource, error) {
+	switch {
+	case url == "":
+		return localSource{folders: folders}, nil
+	case strings.HasPrefix(url, s3Scheme):
+		return newS3Source(url)
+	default:
+		return nil, fmt.Errorf("Unsupported source %s", url)
+	}
+}
+
+// localSource reads the files from local folders
+type localSource struct {
+	folders []string
+}
+
+func (s localSource) Find(maxDepth int, patterns ...string) ([]string, error) {
+	files := findFiles(s.folders, maxDepth, patterns...)
+	if len(files) == 0 {
+		hintPatterns(s.folders, maxDepth, patterns...)
+	}
+	return files, nil
+}
+
+func (localSource) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+
+func (localSource) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+func (localSource) Size(name string) (int64, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
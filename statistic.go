@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"sync"
 
 	"github.com/coveooss/gotemplate/v3/collections"
 )
@@ -117,6 +119,32 @@ func (cum *Statistics) Join(list Statistics) {
 	}
 }
 
+// Sort orders the statistic list by name, count, messages or size (an empty criteria keeps the insertion order)
+func (cum *Statistics) Sort(by string, desc bool) {
+	keys := map[string]func(*Statistic) float64{
+		"count":    func(s *Statistic) float64 { return float64(s.Count()) },
+		"messages": func(s *Statistic) float64 { return float64(s.Messages()) },
+		"size":     func(s *Statistic) float64 { return s.Sum() },
+	}
+	less := func(a, b *Statistic) bool { return a.Name < b.Name }
+	if key := keys[by]; key != nil {
+		less = func(a, b *Statistic) bool {
+			if key(a) == key(b) {
+				return a.Name < b.Name
+			}
+			return key(a) < key(b)
+		}
+	} else if by != "name" {
+		return
+	}
+	sort.SliceStable(cum.List, func(i, j int) bool {
+		if desc {
+			return less(cum.List[j], cum.List[i])
+		}
+		return less(cum.List[i], cum.List[j])
+	})
+}
+
 // GetStats returns a generic list representing the statistics
 func (cum *Statistics) GetStats() collections.IGenericList {
 	result := collections.CreateList(len(cum.List))
@@ -133,3 +161,46 @@ func (cum *Statistics) GetStats() collections.IGenericList {
 	}
 	return result
 }
+
+// SyncStatistics is a Statistics that could be shared by several goroutines
+type SyncStatistics struct {
+	sync.Mutex
+	stats Statistics
+}
+
+// Add statistic to the shared statistic list
+func (cum *SyncStatistics) Add(name string, data interface{}) {
+	cum.Lock()
+	defer cum.Unlock()
+	cum.stats.Add(name, data)
+}
+
+// AddGroup to the shared statistic list
+func (cum *SyncStatistics) AddGroup(name string, stat Statistic) {
+	cum.Lock()
+	defer cum.Unlock()
+	cum.stats.AddGroup(name, stat)
+}
+
+// AddStatistic add statistics to the shared statistic list
+func (cum *SyncStatistics) AddStatistic(s Statistic) {
+	cum.Lock()
+	defer cum.Unlock()
+	cum.stats.AddStatistic(s)
+}
+
+// Join a statistic list to the shared list
+func (cum *SyncStatistics) Join(list Statistics) {
+	cum.Lock()
+	defer cum.Unlock()
+	cum.stats.Join(list)
+}
+
+// Statistics returns a copy of the current statistics that could be used without locking
+func (cum *SyncStatistics) Statistics() Statistics {
+	cum.Lock()
+	defer cum.Unlock()
+	var result Statistics
+	result.Join(cum.stats)
+	return result
+}
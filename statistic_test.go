@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run with go test -race to detect unsynchronized accesses to the shared statistics
+func TestSyncStatisticsConcurrentAdd(t *testing.T) {
+	const goroutines, additions = 8, 500
+	var shared SyncStatistics
+	var wait sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wait.Add(1)
+		go func(id int) {
+			defer wait.Done()
+			for j := 0; j < additions; j++ {
+				shared.AddStatistic(Statistic{Name: fmt.Sprintf("queue-%d", j%10), messages: 1, sum: 2})
+				shared.Add("all", 1)
+				if j%100 == 0 {
+					shared.Statistics()
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	stats := shared.Statistics()
+	if len(stats.List) != 11 {
+		t.Fatalf("Got %d statistics, expected 11", len(stats.List))
+	}
+	for _, stat := range stats.List {
+		expected := goroutines * additions / 10
+		if stat.Name == "all" {
+			expected = goroutines * additions
+		}
+		if stat.Messages() != expected {
+			t.Errorf("%s has %d messages, expected %d", stat.Name, stat.Messages(), expected)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/fatih/color"
+)
+
+// Layout of the classic queue v2 store files (rabbit_classic_queue_store_v2, default since RabbitMQ 3.12)
+// The file starts with a header (magic, version and range of sequence ids) followed by the entries, each entry is
+// made of its size, flags, the CRC32 of the message (lower 16 bits) and a reserved byte followed by the message.
+const (
+	storeV2HeaderBytes = 64
+	storeV2EntryBytes  = 8
+	storeV2CRCFlag     = 0x01
+	storeV2Ext         = ".qs"
+)
+
+// storeV2Magic identifies the classic queue v2 store files ("RCQS" followed by the version)
+var storeV2Magic = []byte{'R', 'C', 'Q', 'S', 2}
+
+// Values of --store-version
+const (
+	storeVersionAuto = "auto" // v2 files are detected by their header
+	storeVersion1    = "1"
+	storeVersion2    = "2" // Force the v2 layout, for files whose header is missing or skipped by --start-offset
+)
+
+// storeVersion selects the layout of the files (set by --store-version)
+var storeVersion = storeVersionAuto
+
+// isStoreV2 determines if the data is a classic queue v2 store file according to --store-version
+func isStoreV2(data []byte) bool {
+	switch storeVersion {
+	case storeVersion1:
+		return false
+	case storeVersion2:
+		return true
+	}
+	return bytes.HasPrefix(data, storeV2Magic)
+}
+
+// readStoreV2Entry returns the blob of the message of the v2 entry at the current position, nil if there is no more
+// entry (the remaining data is filled with zeros). A message whose CRC does not match is reported but kept.
+func (rb *RabbitBlob) readStoreV2Entry(msg *RabbitMessage) *RabbitBlob {
+	if rb.pos < storeV2HeaderBytes && bytes.HasPrefix(rb.data, storeV2Magic) {
+		rb.pos = storeV2HeaderBytes
+		msg.Position = rb.pos
+	}
+	if rb.pos+storeV2EntryBytes > len(rb.data) || binary.BigEndian.Uint32(rb.data[rb.pos:]) == 0 {
+		return nil
+	}
+	msg.Length = int(rb.ReadUInt32())
+	header := rb.ReadBytes(storeV2EntryBytes - 4)
+	data := rb.ReadBytes(msg.Length)
+	if header[0]&storeV2CRCFlag != 0 && uint16(crc32.ChecksumIEEE(data)) != binary.BigEndian.Uint16(header[1:]) {
+		errPrintln(color.YellowString("CRC mismatch for the message at %d in %s, the message may be corrupted", msg.Position, rb.name))
+	}
+	msg.end = rb.pos
+	return &RabbitBlob{data: data, name: rb.name}
+}
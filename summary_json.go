@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// queueSummary is the outcome of the replay of a queue (or exchange) written by --summary-json
+type queueSummary struct {
+	Queue     string `json:"queue,omitempty"`
+	Published int    `json:"published"`
+	Failed    int    `json:"failed"`
+	Returned  int    `json:"returned"`
+	Bytes     int    `json:"bytes"`
+}
+
+// replaySummary is the document written by --summary-json
+type replaySummary struct {
+	Command  string         `json:"command"`
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration_seconds"`
+	Folders  []string       `json:"folders,omitempty"`
+	Targets  []string       `json:"targets"`
+	Queues   []queueSummary `json:"queues"`
+	Totals   queueSummary   `json:"totals"`
+}
+
+// writeSummaryJSON saves the outcome of the replay by queue, the counts of all publishers are added up
+// The targets are identified without their credentials.
+func writeSummaryJSON(fileName, command string, folders []string, started time.Time, options publisherOptions, statuses ...publisherStatus) {
+	summary := replaySummary{
+		Command:  command,
+		Started:  started.UTC(),
+		Duration: time.Since(started).Seconds(),
+		Folders:  folders,
+		Queues:   []queueSummary{},
+	}
+	for target := range options.urls {
+		summary.Targets = append(summary.Targets, options.targetName(target))
+	}
+
+	queues := make(map[string]*queueSummary)
+	get := func(queue string) *queueSummary {
+		if queues[queue] == nil {
+			queues[queue] = &queueSummary{Queue: queue}
+		}
+		return queues[queue]
+	}
+	for _, status := range statuses {
+		for queue, count := range status.published {
+			get(queue).Published += count
+		}
+		for queue, count := range status.failed {
+			get(queue).Failed += count
+		}
+		for queue, count := range status.returned {
+			get(queue).Returned += count
+		}
+		for queue, size := range status.bytes {
+			get(queue).Bytes += size
+		}
+	}
+	for _, queue := range queues {
+		summary.Queues = append(summary.Queues, *queue)
+		summary.Totals.Published += queue.Published
+		summary.Totals.Failed += queue.Failed
+		summary.Totals.Returned += queue.Returned
+		summary.Totals.Bytes += queue.Bytes
+	}
+	sort.Slice(summary.Queues, func(i, j int) bool { return summary.Queues[i].Queue < summary.Queues[j].Queue })
+
+	must(ioutil.WriteFile(fileName, must(json.MarshalIndent(summary, "", "  ")).([]byte), 0644))
+	errPrintln(color.GreenString("Replay summary written to %s", fileName))
+}
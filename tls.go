@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// tlsConfig is the configuration of the amqps connections (set by --tls-ca, --tls-cert, --tls-key and --tls-skip-verify)
+// The default configuration of the amqp library (system CAs, no client certificate) is used if nil.
+var tlsConfig *tls.Config
+
+// newTLSConfig builds the TLS configuration presenting the client certificate (if any) and trusting the CA (the
+// system CAs if empty)
+func newTLSConfig(caFile, certFile, keyFile string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM certificate found in %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be used together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dialAMQP connects to the broker, the amqps urls use the TLS configuration
+func dialAMQP(url string) (*amqp.Connection, error) {
+	if tlsConfig != nil && strings.HasPrefix(url, "amqps://") {
+		return amqp.DialTLS(url, tlsConfig)
+	}
+	return amqp.Dial(url)
+}
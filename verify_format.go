@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// verifyFormat checks that each line of the files is a valid message export (find-lost, split-messages or dump)
+// With the binary encoding, each record must be complete and match its checksum.
+// If checkBodies is set, the decoded bodies must also be non empty and decompress without error when compressed.
+// It returns false if any line is malformed.
+func verifyFormat(files []string, encoding string, checkBodies bool) bool {
+	var lines, malformed int
+	for _, fileName := range files {
+		func() {
+			file := must(os.Open(fileName)).(*os.File)
+			defer file.Close()
+
+			reader, _ := openDecompressed(file)
+			for lineNo := 1; ; lineNo++ {
+				line, _, err := readRecord(reader, encoding)
+				if corrupt, ok := err.(corruptRecord); ok {
+					lines++
+					malformed++
+					errPrintln(color.RedString("%s:%d: %v", fileName, lineNo, corrupt))
+					if corrupt.truncated {
+						return
+					}
+					continue
+				}
+				if err != nil && err != io.EOF {
+					errPrintln(color.RedString("%s:%d: %v", fileName, lineNo, err))
+					malformed++
+					return
+				}
+				if encoding == bodyBinary && err == nil || strings.TrimSpace(line) != "" {
+					lines++
+					if problem := checkExportLine(fileName, line, encoding, checkBodies); problem != nil {
+						errPrintln(color.RedString("%s:%d: %v", fileName, lineNo, problem))
+						malformed++
+					}
+				}
+				if err == io.EOF {
+					return
+				}
+			}
+		}()
+	}
+
+	if malformed > 0 {
+		errPrintln(color.RedString("%d malformed of %d lines in %d files", malformed, lines, len(files)))
+		return false
+	}
+	errPrintln(color.GreenString("All %d lines in %d files are valid", lines, len(files)))
+	return true
+}
+
+// checkExportLine returns the reason why a line is not a valid message export (nil if valid)
+func checkExportLine(fileName, line, encoding string, checkBodies bool) error {
+	msg, err := readExportLine(fileName, line, encoding)
+	if err != nil || !checkBodies {
+		return err
+	}
+	if len(msg.Data) == 0 {
+		return fmt.Errorf("Empty body")
+	}
+	if _, err := msg.Decompress(0); err != nil {
+		return fmt.Errorf("Invalid %s body: %v", msg.Encoding(), err)
+	}
+	return nil
+}
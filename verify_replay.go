@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/streadway/amqp"
+)
+
+// queueVerifier compares the number of messages in the target queues before and after the replay
+// It uses its own channel since a passive declare on a missing queue closes the channel. If the broker cannot be
+// queried anymore, the failure is reported as a run error and the verification fails without stopping the replay.
+type queueVerifier struct {
+	sync.Mutex
+	conn      *amqp.Connection
+	ch        *amqp.Channel
+	baselines map[string]int
+	err       error // Set once the channel could not be reopened
+}
+
+func newQueueVerifier(url string) (*queueVerifier, error) {
+	conn, err := dialAMQP(url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &queueVerifier{conn: conn, ch: ch, baselines: make(map[string]int)}, nil
+}
+
+// count returns the number of messages in the queue, -1 if the queue does not exist or if the broker cannot be queried
+func (v *queueVerifier) count(queue string) int {
+	if v.err != nil {
+		return -1
+	}
+	q, err := v.ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		// The channel is closed by the broker, so we open a new one
+		if v.ch, v.err = v.conn.Channel(); v.err != nil {
+			errPrintln(color.YellowString("Unable to verify queue %s (%v), the remaining queues are not verified", queue, v.err))
+			runErrors.Add(errorVerify, v.err, "", queue, -1)
+		}
+		return -1
+	}
+	return q.Messages
+}
+
+// Baseline records the number of messages in the queue before the first message is published to it
+func (v *queueVerifier) Baseline(queue string) {
+	v.Lock()
+	defer v.Unlock()
+	if _, exist := v.baselines[queue]; !exist {
+		v.baselines[queue] = v.count(queue)
+	}
+}
+
+// Verify compares the number of messages added to each queue with the number of published messages
+func (v *queueVerifier) Verify(statuses ...publisherStatus) bool {
+	v.Lock()
+	defer v.Unlock()
+	queues := make([]string, 0, len(v.baselines))
+	for queue := range v.baselines {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+
+	success := true
+	for _, queue := range queues {
+		var published int
+		for _, status := range statuses {
+			published += status.published[queue]
+		}
+		before, after := v.baselines[queue], v.count(queue)
+		if before < 0 {
+			before = 0
+		}
+		switch {
+		case v.err != nil:
+			return false
+		case after < 0:
+			errPrintln(color.RedString("Queue %s does not exist after publishing %d messages", queue, published))
+			success = false
+		case after-before != published:
+			errPrintln(color.YellowString("Queue %s received %d messages but %d were published (dropped or consumed during the replay?)", queue, after-before, published))
+			success = false
+		}
+	}
+	if success {
+		println(color.GreenString("All %d queue(s) received the published messages", len(queues)))
+	}
+	return success
+}
+
+// Close terminates the connection used for verification
+func (v *queueVerifier) Close() {
+	if v.ch != nil {
+		v.ch.Close()
+	}
+	v.conn.Close()
+}
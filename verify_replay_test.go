@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestVerifierWithoutBroker(t *testing.T) {
+	// A port that has just been released, so the connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	if verifier, err := newQueueVerifier("amqp://guest:guest@" + listener.Addr().String()); err == nil || verifier != nil {
+		t.Errorf("newQueueVerifier() = %v, %v, expected an error without broker", verifier, err)
+	}
+}
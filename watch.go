@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// fileWatcher polls the folders for files that appeared (or changed) since they have been processed
+// Files are identified by name and modification time. A new file is only returned once its modification time
+// has been stable for one interval, so segments still being flushed by the node are not read partially.
+type fileWatcher struct {
+	find      func() []string
+	interval  time.Duration
+	processed map[string]time.Time // Modification time of the files already processed
+	pending   map[string]time.Time // Modification time of the new files seen by the last poll
+}
+
+func newFileWatcher(find func() []string, interval time.Duration, processed []string) *fileWatcher {
+	w := &fileWatcher{find: find, interval: interval, processed: make(map[string]time.Time), pending: make(map[string]time.Time)}
+	for _, file := range processed {
+		w.processed[file] = modTime(file)
+	}
+	return w
+}
+
+// Watch sends the batches of new files until an interrupt (or termination) signal is received
+// A second interrupt terminates the process immediately.
+func (w *fileWatcher) Watch(send func([]string)) {
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-interrupted:
+			return
+		case <-ticker.C:
+			if files := w.poll(); len(files) > 0 {
+				send(files)
+			}
+		}
+	}
+}
+
+// poll returns the files whose modification time differs from the processed one and did not change since the last poll
+func (w *fileWatcher) poll() (ready []string) {
+	pending := make(map[string]time.Time)
+	for _, file := range w.find() {
+		mtime := modTime(file)
+		if processed, ok := w.processed[file]; ok && processed.Equal(mtime) {
+			continue
+		}
+		if previous, ok := w.pending[file]; ok && previous.Equal(mtime) {
+			w.processed[file] = mtime
+			ready = append(ready, file)
+			continue
+		}
+		pending[file] = mtime
+	}
+	w.pending = pending
+	return ready
+}
+
+// modTime returns the modification time of a file (zero if it cannot be read)
+func modTime(file string) time.Time {
+	if info, err := os.Stat(file); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}